@@ -0,0 +1,212 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+)
+
+// Point is a position in the plane of an arc
+type Point struct {
+	X, Y float64
+}
+
+func (p Point) Sub(q Point) Point {
+	return Point{p.X - q.X, p.Y - q.Y}
+}
+
+func (p Point) Dist(q Point) float64 {
+	return math.Hypot(p.X-q.X, p.Y-q.Y)
+}
+
+// Arc is a circular arc from Start around Center, Sweep > 0 is counter-clockwise (G3), < 0 is clockwise (G2)
+type Arc struct {
+	Start, Center Point
+	Sweep         float64 // radians
+}
+
+func (a Arc) Radius() float64 {
+	return a.Start.Dist(a.Center)
+}
+
+func (a Arc) Clockwise() bool {
+	return a.Sweep < 0
+}
+
+func (a Arc) Length() float64 {
+	return math.Abs(a.Sweep) * a.Radius()
+}
+
+// At returns the point of the arc at the angle from Start
+func (a Arc) At(angle float64) Point {
+	v := a.Start.Sub(a.Center)
+	sin, cos := math.Sincos(angle)
+	return Point{a.Center.X + v.X*cos - v.Y*sin, a.Center.Y + v.X*sin + v.Y*cos}
+}
+
+func (a Arc) End() Point {
+	return a.At(a.Sweep)
+}
+
+// Deviation returns the max distance from the points to the circle of the arc
+func (a Arc) Deviation(points ...Point) (d float64) {
+	r := a.Radius()
+	for _, p := range points {
+		d = math.Max(d, math.Abs(p.Dist(a.Center)-r))
+	}
+	return d
+}
+
+// circleThrough returns the center of the circle through the points, ok is false if they are on a line
+func circleThrough(p1, p2, p3 Point) (c Point, ok bool) {
+	a, b := p2.Sub(p1), p3.Sub(p1)
+	d := 2 * (a.X*b.Y - a.Y*b.X)
+	if math.Abs(d) < 1e-9 {
+		return c, false
+	}
+	a2, b2 := a.X*a.X+a.Y*a.Y, b.X*b.X+b.Y*b.Y
+	return Point{p1.X + (b.Y*a2-a.Y*b2)/d, p1.Y + (a.X*b2-b.X*a2)/d}, true
+}
+
+/*
+fitArc fits the polyline of points (at least 3) to an arc from the first to the last point,
+both the points and the middle of the segments must be within tol of the arc, and the points must
+go around the center in one direction, less than a full circle.
+*/
+func fitArc(points []Point, tol float64) (arc Arc, ok bool) {
+	if len(points) < 3 {
+		return arc, false
+	}
+	first, last := points[0], points[len(points)-1]
+	c, ok := circleThrough(first, points[len(points)/2], last)
+	if !ok {
+		return arc, false
+	}
+	arc = Arc{Start: first, Center: c}
+
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		mid := Point{(p.X + q.X) / 2, (p.Y + q.Y) / 2}
+		if arc.Deviation(q, mid) > tol {
+			return arc, false
+		}
+		u, v := p.Sub(c), q.Sub(c)
+		step := math.Atan2(u.X*v.Y-u.Y*v.X, u.X*v.X+u.Y*v.Y)
+		if step == 0 || (arc.Sweep != 0 && (step > 0) != (arc.Sweep > 0)) {
+			return arc, false
+		}
+		arc.Sweep += step
+	}
+	if math.Abs(arc.Sweep) >= 2*math.Pi-1e-6 {
+		return arc, false
+	}
+	return arc, true
+}
+
+// Segments returns the points of the chords which are within tol of the arc, from Start (not included) to End
+func (a Arc) Segments(tol float64) []Point {
+	r := a.Radius()
+	step := math.Pi // the widest chord is the diameter
+	if tol < r {
+		step = 2 * math.Acos(1-tol/r)
+	}
+	n := int(math.Ceil(math.Abs(a.Sweep)/step - 1e-9))
+	if n < 1 {
+		n = 1
+	}
+	points := make([]Point, n)
+	for i := 1; i <= n; i++ {
+		points[i-1] = a.At(a.Sweep * float64(i) / float64(n))
+	}
+	return points
+}
+
+// Plane of arcs, set by G17/G18/G19
+type Plane int
+
+const (
+	PlaneXY Plane = iota // G17
+	PlaneZX              // G18
+	PlaneYZ              // G19
+)
+
+// axes returns the words of the first and second axis, their offsets of the center, and the linear axis
+func (p Plane) axes() (a, b, offA, offB, linear byte) {
+	switch p {
+	case PlaneZX:
+		return 'Z', 'X', 'K', 'I', 'Y'
+	case PlaneYZ:
+		return 'Y', 'Z', 'J', 'K', 'X'
+	}
+	return 'X', 'Y', 'I', 'J', 'Z'
+}
+
+// ArcMove is a G2/G3 in a plane, the linear axis moves along the arc as a helix
+type ArcMove struct {
+	Arc
+	Plane  Plane
+	Linear float64 // distance of the linear axis
+}
+
+func axisOf(s MachineState, word byte) float64 {
+	switch word {
+	case 'X':
+		return s.X
+	case 'Y':
+		return s.Y
+	}
+	return s.Z
+}
+
+/*
+NewArcMove returns the arc of G2/G3 from the position of from to the position of to (the state after the line),
+the center is given by the offsets I/J/K, or the radius R which is negative for the arcs more than 180°.
+The arc is a full circle if it ends at the start by I/J/K.
+*/
+func NewArcMove(g *GcodeBlock, plane Plane, from, to MachineState) (m ArcMove, err error) {
+	if !g.Is("G2") && !g.Is("G3") {
+		return m, fmt.Errorf("%s is not an arc", g.Cmd())
+	}
+	a, b, offA, offB, linear := plane.axes()
+	var (
+		clockwise = g.Is("G2")
+		start     = Point{axisOf(from, a), axisOf(from, b)}
+		end       = Point{axisOf(to, a), axisOf(to, b)}
+	)
+	m = ArcMove{Arc: Arc{Start: start}, Plane: plane, Linear: axisOf(to, linear) - axisOf(from, linear)}
+
+	if r, ok := g.paramFloat('R'); ok {
+		if start == end {
+			return m, fmt.Errorf("%s: R needs an end point other than the start", g.Cmd())
+		}
+		var (
+			d    = start.Dist(end)
+			h    = math.Sqrt(math.Max(r*r-d*d/4, 0)) // distance from the middle to the center
+			side = 1.0
+		)
+		if clockwise != (r < 0) {
+			side = -1
+		}
+		m.Center = Point{(start.X+end.X)/2 - side*h*(end.Y-start.Y)/d, (start.Y+end.Y)/2 + side*h*(end.X-start.X)/d}
+	} else {
+		i, okA := g.paramFloat(offA)
+		j, okB := g.paramFloat(offB)
+		if !okA && !okB {
+			return m, fmt.Errorf("%s: missing %c/%c or R", g.Cmd(), offA, offB)
+		}
+		m.Center = Point{start.X + i, start.Y + j}
+	}
+
+	// the angle from start to end around the center, as the firmware does
+	u, v := start.Sub(m.Center), end.Sub(m.Center)
+	m.Sweep = math.Atan2(u.X*v.Y-u.Y*v.X, u.X*v.X+u.Y*v.Y)
+	if m.Sweep < 0 {
+		m.Sweep += 2 * math.Pi
+	}
+	if clockwise {
+		m.Sweep -= 2 * math.Pi
+	}
+	if m.Sweep == 0 && start == end {
+		m.Sweep = 2 * math.Pi
+	}
+	return m, nil
+}
@@ -0,0 +1,153 @@
+package fix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type arcExpandConfig struct {
+	tolerance float64 // mm, of the chords
+	radius    float64 // mm, expand the arcs smaller than it, 0 is all
+}
+
+func newArcExpandConfig(ctx *Context) (c arcExpandConfig, err error) {
+	c = arcExpandConfig{
+		tolerance: ctx.Options.Float("arcexpand.tolerance", 0.01),
+		radius:    ctx.Options.Float("arcexpand.radius", 0),
+	}
+	if c.tolerance <= 0 {
+		return c, fmt.Errorf("arcexpand.tolerance must be positive")
+	}
+	return c, nil
+}
+
+/*
+expandArcs replaces G2/G3 by G1 chords within "arcexpand.tolerance" (0.01mm) of the arcs,
+for the firmware which draws the small arcs badly. Only the arcs smaller than "arcexpand.radius" are expanded
+if it is set.
+
+Both I/J/K and R forms are supported in the plane of G17/G18/G19, E and the linear axis are split
+by the chords evenly, the feedrate is kept.
+*/
+func expandArcs(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	cfg, err := newArcExpandConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		output = make([]*GcodeBlock, 0, len(gcodes))
+		state  = NewMachineState()
+		plane  = PlaneXY
+	)
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+		switch {
+		case g.Is("G17"):
+			plane = PlaneXY
+		case g.Is("G18"):
+			plane = PlaneZX
+		case g.Is("G19"):
+			plane = PlaneYZ
+		}
+		if !g.Is("G2") && !g.Is("G3") {
+			output = append(output, g)
+			continue
+		}
+
+		m, err := NewArcMove(g, plane, prev, state)
+		if err != nil {
+			ctx.Warnf("line %d: %s", n+1, err)
+			output = append(output, g)
+			continue
+		}
+		if cfg.radius > 0 && m.Radius() >= cfg.radius {
+			output = append(output, g)
+			continue
+		}
+		chords := segmentArc(m, cfg.tolerance, g, prev, state)
+		if chords[0].Comment() != "" {
+			chords[0].AppendComment(" ;(Fixed: %s to %d G1)", g.Cmd(), len(chords))
+		} else {
+			chords[0].SetComment(";(Fixed: %s to %d G1)", g.Cmd(), len(chords))
+		}
+		output = append(output, chords...)
+		ctx.Record(n, "%s to %d G1", g.Cmd(), len(chords))
+	}
+	return output, nil
+}
+
+// segmentArc returns the G1 chords of the arc move g, from the state prev to state
+func segmentArc(m ArcMove, tol float64, g *GcodeBlock, prev, state MachineState) []*GcodeBlock {
+	var (
+		points             = m.Segments(tol)
+		count              = float64(len(points))
+		a, b, _, _, linear = m.Plane.axes()
+		chords             = make([]*GcodeBlock, 0, len(points))
+		last               = prev // position of the last chord, as written
+		e                  = state.E - prev.E
+		eLast              float64 // extruded by the last chord, as written
+	)
+	round := func(v float64, decimals int) float64 {
+		v, _ = strconv.ParseFloat(formatArcNum(v, decimals), 64)
+		return v
+	}
+	for i, p := range points {
+		cur := last
+		set := func(word byte, v float64) {
+			v = round(v, 3)
+			switch word {
+			case 'X':
+				cur.X = v
+			case 'Y':
+				cur.Y = v
+			case 'Z':
+				cur.Z = v
+			}
+		}
+		set(a, p.X)
+		set(b, p.Y)
+		set(linear, axisOf(prev, linear)+m.Linear*float64(i+1)/count)
+		if i == len(points)-1 {
+			cur.X, cur.Y, cur.Z = state.X, state.Y, state.Z // exactly at the end
+		}
+
+		var s strings.Builder
+		s.WriteString("G1")
+		for _, word := range []byte{'X', 'Y', 'Z'} {
+			from, to := axisOf(last, word), axisOf(cur, word)
+			if from == to && !(i == len(points)-1 && g.HasParam(word)) {
+				continue
+			}
+			if prev.Relative {
+				to -= from
+			}
+			fmt.Fprintf(&s, " %c%s", word, formatArcNum(to, 3))
+		}
+		if e != 0 {
+			done := round(e*float64(i+1)/count, 5)
+			if i == len(points)-1 {
+				done = e
+			}
+			if prev.RelativeE {
+				fmt.Fprintf(&s, " E%.5f", done-eLast)
+			} else {
+				fmt.Fprintf(&s, " E%.5f", prev.E+done)
+			}
+			eLast = done
+		}
+		if i == 0 && g.HasParam('F') {
+			fmt.Fprintf(&s, " F%s", formatArcNum(state.F, 3))
+		}
+		if i == 0 && g.Comment() != "" {
+			s.WriteString(" " + g.Comment())
+		}
+		if chord, err := ParseGcodeBlock(s.String()); err == nil {
+			chords = append(chords, chord)
+		}
+		last = cur
+	}
+	return chords
+}
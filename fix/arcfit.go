@@ -0,0 +1,208 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+type arcFitConfig struct {
+	tolerance     float64 // mm
+	minSegments   int
+	minRadius     float64 // mm
+	maxRadius     float64 // mm
+	flowTolerance float64 // of E per mm
+}
+
+func newArcFitConfig(ctx *Context) (c arcFitConfig, err error) {
+	c = arcFitConfig{
+		tolerance:     ctx.Options.Float("arcfit.tolerance", 0.05),
+		minSegments:   ctx.Options.Int("arcfit.min_segments", 3),
+		minRadius:     ctx.Options.Float("arcfit.min_radius", 0.5),
+		maxRadius:     ctx.Options.Float("arcfit.max_radius", 1000),
+		flowTolerance: ctx.Options.Float("arcfit.flow_tolerance", 0.1),
+	}
+	switch {
+	case c.tolerance <= 0:
+		return c, fmt.Errorf("arcfit.tolerance must be positive")
+	case c.minSegments < 2:
+		return c, fmt.Errorf("arcfit.min_segments must be 2 or more")
+	}
+	return c, nil
+}
+
+// arcMove is an extruding G1 in a run which may be an arc
+type arcMove struct {
+	g     *GcodeBlock
+	n     int
+	state MachineState // after the move
+	e     float64      // extruded
+}
+
+// arcRun collects the moves which can be fitted together, from the position of start
+type arcRun struct {
+	start MachineState
+	moves []arcMove
+}
+
+// accepts reports if the move can be added to the run
+func (r *arcRun) accepts(cfg arcFitConfig, g *GcodeBlock, prev, state MachineState) bool {
+	if !g.Is("G1") || prev.Relative || (!g.HasParam('X') && !g.HasParam('Y')) {
+		return false
+	}
+	for _, p := range g.Params() {
+		switch p.Word() {
+		case 'X', 'Y', 'E', 'F':
+		default:
+			return false
+		}
+	}
+	e, length := state.E-prev.E, math.Hypot(state.X-prev.X, state.Y-prev.Y)
+	if e <= 0 || length == 0 || len(r.moves) == 0 {
+		return e > 0 && length > 0
+	}
+	// one F and one comment for the arc
+	if g.Comment() != "" || (g.HasParam('F') && state.F != r.moves[0].state.F) || state.RelativeE != prev.RelativeE {
+		return false
+	}
+	first := r.moves[0]
+	flow := first.e / math.Hypot(first.state.X-r.start.X, first.state.Y-r.start.Y)
+	return math.Abs(e/length-flow) <= flow*cfg.flowTolerance
+}
+
+func (r *arcRun) points(i, j int) []Point {
+	from := r.start
+	if i > 0 {
+		from = r.moves[i-1].state
+	}
+	points := []Point{{from.X, from.Y}}
+	for _, m := range r.moves[i:j] {
+		points = append(points, Point{m.state.X, m.state.Y})
+	}
+	return points
+}
+
+// fit returns the longest arc of the moves from i, and the number of moves in it
+func (r *arcRun) fit(cfg arcFitConfig, i int) (arc Arc, count int) {
+	for j := i + cfg.minSegments; j <= len(r.moves); j++ {
+		a, ok := fitArc(r.points(i, j), cfg.tolerance)
+		if !ok || a.Radius() < cfg.minRadius || a.Radius() > cfg.maxRadius {
+			break
+		}
+		arc, count = a, j-i
+	}
+	return
+}
+
+// gcode returns G2/G3 of the arc for the moves [i, i+count)
+func (r *arcRun) gcode(arc Arc, i, count int) (*GcodeBlock, error) {
+	var (
+		first = r.moves[i]
+		last  = r.moves[i+count-1]
+		cmd   = "G3"
+		e     = last.state.E
+	)
+	if arc.Clockwise() {
+		cmd = "G2"
+	}
+	if last.state.RelativeE {
+		e = 0
+		for _, m := range r.moves[i : i+count] {
+			e += m.e
+		}
+	}
+	s := fmt.Sprintf("%s X%s Y%s I%s J%s E%.5f", cmd,
+		formatArcNum(last.state.X, 3), formatArcNum(last.state.Y, 3),
+		formatArcNum(arc.Center.X-arc.Start.X, 3), formatArcNum(arc.Center.Y-arc.Start.Y, 3), e)
+	if first.g.HasParam('F') {
+		s += " F" + formatArcNum(first.state.F, 3)
+	}
+	if first.g.Comment() != "" {
+		s += " " + first.g.Comment()
+	}
+	return ParseGcodeBlock(s)
+}
+
+func formatArcNum(v float64, decimals int) string {
+	p := math.Pow(10, float64(decimals))
+	v = math.Round(v*p) / p
+	if v == 0 {
+		v = 0 // no -0
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+/*
+fitArcs replaces the runs of extruding G1 moves by G2/G3 arcs, the printer gets fewer and smoother moves on curves:
+
+  - the moves are within "arcfit.tolerance" (0.05mm) of the arc, the middle of the segments too
+  - an arc has "arcfit.min_segments" (3) moves at least, its radius is in "arcfit.min_radius" (0.5mm)
+    to "arcfit.max_radius" (1000mm)
+  - the moves extrude the same E per mm, within "arcfit.flow_tolerance" (10%), the arc extrudes the sum of them
+  - Z, F and comments in the middle of a run, travel moves and retractions are kept as they are
+
+Both absolute and relative E are supported, the positions must be absolute.
+*/
+func fitArcs(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	cfg, err := newArcFitConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		output         = make([]*GcodeBlock, 0, len(gcodes))
+		state          = NewMachineState()
+		run            arcRun
+		arcs, replaced int
+		before, after  int // bytes of the replaced moves and the arcs
+		total          int // bytes of the input
+	)
+	flush := func() {
+		for i := 0; i < len(run.moves); {
+			arc, count := run.fit(cfg, i)
+			if count == 0 {
+				output = append(output, run.moves[i].g)
+				i++
+				continue
+			}
+			g, err := run.gcode(arc, i, count)
+			if err != nil {
+				output = append(output, run.moves[i].g)
+				i++
+				continue
+			}
+			for _, m := range run.moves[i : i+count] {
+				before += len(m.g.String()) + 1
+			}
+			after += len(g.String()) + 1
+			output = append(output, g)
+			ctx.Record(run.moves[i].n, "%d moves to %s", count, g.Cmd())
+			arcs, replaced = arcs+1, replaced+count
+			i += count
+		}
+		run.moves = run.moves[:0]
+	}
+
+	for n, g := range gcodes {
+		total += len(g.String()) + 1
+		prev := state
+		state.Update(g)
+		if !run.accepts(cfg, g, prev, state) {
+			flush() // and try to start a new run
+		}
+		if run.accepts(cfg, g, prev, state) {
+			if len(run.moves) == 0 {
+				run.start = prev
+			}
+			run.moves = append(run.moves, arcMove{g: g, n: n, state: state, e: state.E - prev.E})
+			continue
+		}
+		output = append(output, g)
+	}
+	flush()
+
+	if arcs > 0 && total > 0 {
+		ctx.Logf("%d arcs from %d moves, %d bytes smaller (-%.1f%%)", arcs, replaced, before-after, float64(before-after)*100/float64(total))
+	}
+	return output, nil
+}
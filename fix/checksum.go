@@ -0,0 +1,38 @@
+package fix
+
+/*
+renumberLines regenerates the line numbers N and the checksums of the lines which have them, for the files sent
+over serial: modifiers insert and remove lines, so the lines with N are numbered one by one from the first N,
+and M110 N sets the number of the line before the next one. The lines without N are kept as they are.
+*/
+func renumberLines(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	var (
+		output = make([]*GcodeBlock, 0, len(gcodes))
+		next   int64
+		first  = true
+	)
+	for n, g := range gcodes {
+		num, ok := g.LineNumber()
+		if !ok {
+			output = append(output, g)
+			continue
+		}
+		if first {
+			next, first = num, false
+		}
+
+		fixed := g.Copy()
+		fixed.SetLineNumber(next)
+		if fixed.String() != g.String() {
+			ctx.Record(n, "N%d*%s to N%d*%s", num, g.Checksum(), next, fixed.Checksum())
+			g = fixed
+		}
+		output = append(output, g)
+
+		next++
+		if v, ok := g.paramFloat('N'); ok && g.Is("M110") {
+			next = int64(v) + 1
+		}
+	}
+	return output, nil
+}
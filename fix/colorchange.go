@@ -0,0 +1,86 @@
+package fix
+
+import (
+	"fmt"
+)
+
+// ColorChangeSteps replace the tool changes on the single nozzle, "colorchange.steps" overwrites them
+var ColorChangeSteps = []string{StepRetract, StepPark, StepMessage, StepBeep, StepPause, StepWait, StepPurge, StepUnretract, StepReturn}
+
+// colorTag marks the filaments in the order of printing, ParseParams reads the color sequence from them
+const colorTag = ";(Fixed: color %d: %s)"
+
+func newColorChangeConfig(ctx *Context) (c toolChangeConfig, err error) {
+	c = toolChangeConfig{
+		name:         "color change",
+		steps:        ColorChangeSteps,
+		lift:         ctx.Options.Float("colorchange.lift", 10),
+		zSpeed:       ctx.Options.Float("colorchange.z_speed", 3000),
+		retractSpeed: ctx.Options.Float("colorchange.retract_speed", 2400),
+		purgeSpeed:   ctx.Options.Float("colorchange.purge_speed", 300),
+		purge:        ctx.Options.Float("colorchange.purge", 20),
+		single:       true,
+		parkX:        ctx.Options.Float("colorchange.park_x", 0),
+		parkY:        ctx.Options.Float("colorchange.park_y", 0),
+		travelSpeed:  ctx.Options.Float("colorchange.travel_speed", 6000),
+		beep:         ctx.Options.Str("colorchange.beep", "M300 S440 P200"),
+		pause:        ctx.Options.Str("colorchange.pause", "M600"),
+	}
+	if c.pause == "" {
+		return c, fmt.Errorf("colorchange.pause is empty")
+	}
+	if c.purge < 0 {
+		c.purge = 0
+	}
+	if v := ctx.Options.Str("colorchange.steps", ""); v != "" {
+		c.steps, err = parseSteps("colorchange.steps", v, StepPause,
+			StepRetract, StepPark, StepMessage, StepBeep, StepPause, StepWait, StepPurge, StepUnretract, StepReturn)
+	}
+	return c, err
+}
+
+/*
+changeColors prints the tools of the slicer by the single nozzle, each tool change becomes a filament change:
+park, retract, beep, and wait for the user to load the filament by "colorchange.pause" (M600), then purge.
+
+The nozzle parks at "colorchange.park_x"/"park_y" (0, 0, nan to keep X/Y) and "colorchange.lift" (10mm) above the print,
+"colorchange.purge" (20mm) is extruded there. The filaments are tagged in the order of printing for the header,
+all tools are replaced by T0 at last, only the filament used of them are summed to T0.
+
+It does nothing on the printers with two nozzles.
+*/
+func changeColors(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	if !ctx.Params.SingleNozzle() {
+		return gcodes, nil
+	}
+	cfg, err := newColorChangeConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		usage   = scanToolUsage(gcodes)
+		changes = findToolChanges(gcodes)
+		output  = gcodes
+	)
+	if len(changes) > 0 {
+		output = writeToolChanges(ctx, gcodes, cfg, changes, func(i int, c toolChange) string {
+			return fmt.Sprintf(colorTag, i+2, usage.describe(c.to))
+		})
+		for n, g := range output {
+			if tool, err := g.GetToolNum(); err == nil && g.Cmd().Word() == 'T' {
+				tag, _ := ParseGcodeBlock(fmt.Sprintf(colorTag, 1, usage.describe(tool)))
+				output = append(output[:n], append([]*GcodeBlock{tag}, output[n:]...)...)
+				break
+			}
+		}
+		ctx.Logf("%d color changes, each one needs to load the filament by hand", len(changes))
+	}
+
+	m := ToolMap{0: 0}
+	for t := range usage.referred {
+		m[t] = 0
+	}
+	// the filaments are changed by hand, so the tools keep their own materials and settings
+	return replaceTools(ctx, output, m, usage.sources(m), true), nil
+}
@@ -0,0 +1,46 @@
+package fix
+
+import (
+	"strings"
+)
+
+// compactKeeps are the comments kept by Compact, besides the layer markers
+var compactKeeps = []string{
+	";(Fixed: color ", // the color sequence of the header
+}
+
+// keepComment reports if the comment line g is needed after Compact
+func keepComment(g *GcodeBlock) bool {
+	if m := layerMarker(g); m.kind != "" || m.z > 0 {
+		return true
+	}
+	for _, prefix := range compactKeeps {
+		if strings.HasPrefix(g.Comment(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Compact returns the gcodes without the comments, for the printers which scan large files slowly on USB,
+it must be called after the header is extracted, as the slicer config and thumbnails are dropped too.
+
+The commands are kept without their comments, the layer markers and the color tags are kept as they are.
+*/
+func Compact(gcodes []*GcodeBlock) []*GcodeBlock {
+	output := make([]*GcodeBlock, 0, len(gcodes))
+	for _, g := range gcodes {
+		switch {
+		case g.IsComment():
+			if !keepComment(g) {
+				continue
+			}
+		case g.Comment() != "":
+			g = g.Copy()
+			g.SetComment("")
+		}
+		output = append(output, g)
+	}
+	return output
+}
@@ -0,0 +1,136 @@
+package fix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FanMap is the part cooling fan (P of M106) of each tool
+type FanMap map[int32]int
+
+/*
+NewFanMap returns the fans of the printer, each nozzle of the dual extruders module and J1 has its own fan,
+"fan.map" overwrites it, e.g. "0:0,1:1".
+*/
+func NewFanMap(ctx *Context) (FanMap, error) {
+	m := FanMap{}
+	if ctx.Params.ToolHead == ToolheadDual || ctx.Params.Model == ModelJ1 {
+		m[0], m[1] = 0, 1
+	}
+	v := ctx.Options.Str("fan.map", "")
+	if v == "" {
+		return m, nil
+	}
+	m = FanMap{}
+	for _, pair := range strings.Split(v, ",") {
+		t, p, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		tool, err1 := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(t), "T"), 10, 32)
+		fan, err2 := strconv.Atoi(strings.TrimSpace(p))
+		if !ok || err1 != nil || err2 != nil || tool < 0 || fan < 0 || fan >= MaxTools {
+			return nil, fmt.Errorf("invalid fan.map %q, want tool:fan", pair)
+		}
+		m[int32(tool)] = fan
+	}
+	return m, nil
+}
+
+// Of returns the fan of the tool, 0 if unknown
+func (m FanMap) Of(tool int32) int {
+	if tool < 0 {
+		tool = 0
+	}
+	return m[tool]
+}
+
+/*
+normalizeFans makes the fan commands follow the tools:
+
+  - M106/M107 without P is for the fan of the current tool
+  - the fan speed is carried to the new tool on tool changes, unless the slicer sets it before printing
+  - the fan of the idle tool is turned off if "fan.idle_off" is true
+*/
+func normalizeFans(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	fans, err := NewFanMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idleOff := ctx.Options.Bool("fan.idle_off", false)
+
+	var (
+		output = make([]*GcodeBlock, 0, len(gcodes)+64)
+		state  = NewMachineState() // of the output
+	)
+	emit := func(format string, args ...any) {
+		if g, err := ParseGcodeBlock(fmt.Sprintf(format, args...)); err == nil {
+			output = append(output, g)
+			state.Update(g)
+		}
+	}
+
+	for n, g := range gcodes {
+		if (g.Is("M106") || g.Is("M107")) && !g.HasParam('P') {
+			tool := state.Tool
+			if tool < 0 {
+				tool = 0
+			}
+			if fan := fans.Of(tool); fan != 0 || len(fans) > 1 {
+				g.SetParam('P', strconv.Itoa(fan))
+				if g.Comment() == "" {
+					g.SetComment(";(Fixed: fan of T%d)", tool)
+				} else {
+					g.AppendComment(" ;(Fixed: fan of T%d)", tool)
+				}
+				ctx.Record(n, "fan P%d of T%d", fan, tool)
+			}
+		}
+
+		prev := state.Tool
+		output = append(output, g)
+		state.Update(g)
+		if g.Cmd().Word() != 'T' || prev < 0 || prev == state.Tool {
+			continue
+		}
+
+		from, to := fans.Of(prev), fans.Of(state.Tool)
+		if from == to {
+			continue
+		}
+		speed := state.Fans[from]
+		if idleOff && speed > 0 {
+			emit("M107 P%d ;(Fixed: idle fan of T%d)", from, prev)
+			ctx.Record(n, "turn off the fan of T%d", prev)
+		}
+		if state.Fans[to] != speed && !setsFanBeforePrint(gcodes[n+1:], to, fans, state.Tool) {
+			if speed > 0 {
+				emit("M106 P%d S%g ;(Fixed: fan of T%d)", to, speed, state.Tool)
+			} else {
+				emit("M107 P%d ;(Fixed: fan of T%d)", to, state.Tool)
+			}
+			ctx.Record(n, "carry fan speed %g to T%d", speed, state.Tool)
+		}
+	}
+	return output, nil
+}
+
+// setsFanBeforePrint reports if there is a command for the fan before the next extrusion or tool change
+func setsFanBeforePrint(gcodes []*GcodeBlock, fan int, fans FanMap, tool int32) bool {
+	state := NewMachineState()
+	for _, g := range gcodes {
+		e := state.E
+		state.Update(g)
+		switch {
+		case g.Cmd().Word() == 'T', isExtruding(g, state.E, e):
+			return false
+		case g.Is("M106"), g.Is("M107"):
+			p := fans.Of(tool)
+			if v, ok := g.paramFloat('P'); ok {
+				p = int(v)
+			}
+			if p == fan {
+				return true
+			}
+		}
+	}
+	return false
+}
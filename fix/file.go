@@ -0,0 +1,145 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// line endings of gcode files
+const (
+	LF   = "\n"
+	CRLF = "\r\n"
+	CR   = "\r" // classic Mac OS
+)
+
+var (
+	// MaxLineSize is the max bytes of a line read by ReadGcode, without the line ending
+	MaxLineSize = 64 << 20
+
+	ErrLineTooLong = errors.New("line too long")
+
+	bom = []byte("\xEF\xBB\xBF")
+)
+
+// scanLines splits the lines at "\n", "\r\n" or "\r", like bufio.ScanLines which only knows "\n"
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		switch {
+		case data[i] == '\n':
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil // "\n" may follow
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// latin1 returns the line as UTF-8, the lines which are not UTF-8 are Latin-1, e.g. comments of slicers on Windows
+func latin1(line []byte) string {
+	if utf8.Valid(line) {
+		return string(line)
+	}
+	var s strings.Builder
+	s.Grow(len(line) * 2)
+	for _, c := range line {
+		s.WriteRune(rune(c))
+	}
+	return s.String()
+}
+
+// lineEnding returns the ending of the first line in data, LF if there is none, atEOF is true if data is the whole file
+func lineEnding(data []byte, atEOF bool) string {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 && data[i] == '\r' {
+		switch {
+		case i+1 < len(data) && data[i+1] == '\n':
+			return CRLF
+		case i+1 < len(data) || atEOF:
+			return CR
+		}
+	}
+	return LF
+}
+
+/*
+ReadGcode reads the gcodes of r, empty lines are skipped, eol is the line ending of the file (LF, CRLF or CR)
+to write it back in the same style.
+
+The lines can end with "\n", "\r\n" or "\r", the UTF-8 BOM is dropped, and the lines which are not UTF-8
+are read as Latin-1. The lines can be as long as MaxLineSize, e.g. base64 thumbnails or start_gcode in one line.
+It returns ErrIsFixed for the files which are fixed already.
+*/
+func ReadGcode(r io.Reader) (gcodes []*GcodeBlock, eol string, err error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(bom)); bytes.Equal(head, bom) {
+		br.Discard(len(bom))
+	}
+	if head, err := br.Peek(4096); len(head) > 0 {
+		eol = lineEnding(head, err != nil)
+	} else {
+		eol = LF
+	}
+
+	sc := bufio.NewScanner(br)
+	sc.Split(scanLines)
+	sc.Buffer(make([]byte, 0, 64*1024), MaxLineSize+len(CRLF))
+	tooLong := func(n int) error {
+		return fmt.Errorf("line %d: %w, it is longer than %d bytes", n, ErrLineTooLong, MaxLineSize)
+	}
+	n := 1
+	for ; sc.Scan(); n++ {
+		if len(sc.Bytes()) > MaxLineSize {
+			return nil, eol, tooLong(n)
+		}
+		line := latin1(sc.Bytes())
+		if strings.HasPrefix(line, "; Postprocessed by smfix") {
+			return nil, eol, ErrIsFixed
+		}
+
+		g, err := ParseGcodeBlock(line)
+		if err == nil {
+			gcodes = append(gcodes, g)
+			continue
+		}
+		if err != ErrEmptyString {
+			return nil, eol, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := sc.Err(); err == bufio.ErrTooLong {
+		return nil, eol, tooLong(n)
+	} else if err != nil {
+		return nil, eol, err
+	}
+	return gcodes, eol, nil
+}
+
+// WriteGcode writes the header and the gcodes, each line ends with eol, the header is rendered for the gcodes by ExtractHeader
+func WriteGcode(w io.Writer, headers [][]byte, gcodes []*GcodeBlock, eol string) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	header := bytes.Join(headers, []byte(LF))
+	if eol != LF {
+		header = bytes.ReplaceAll(header, []byte(LF), []byte(eol))
+	}
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	for _, g := range gcodes {
+		if _, err := bw.WriteString(g.String() + eol); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -17,11 +17,30 @@ const (
 	GCODE_SEPARATOR = " "
 )
 
+// kinds of the addr of Gcode, parsed once when it is read as a number
+const (
+	addrUnparsed = iota
+	addrText
+	addrFloat
+	addrInt
+)
+
 type Gcode struct {
 	word byte
-	addr string
+	addr string // as it is written, echoed if it is not changed
+
+	kind uint8
+	f    float64 // addrFloat, addrInt
+	i    int64   // addrInt
+	err  error   // addrText
 }
 
+// Precision is the decimals of the float addrs set by SetAddr, by word, the others are DefaultPrecision
+var (
+	Precision        = map[byte]int{'E': 5, 'X': 3, 'Y': 3, 'Z': 3, 'F': 3}
+	DefaultPrecision = 3
+)
+
 func (g *Gcode) Word() byte {
 	return g.word
 }
@@ -34,75 +53,115 @@ func (g *Gcode) Addr() string {
 	return g.addr
 }
 
+// parse parses the addr as a number once, it is not safe for concurrent use as the blocks
+func (g *Gcode) parse() {
+	if g.kind != addrUnparsed {
+		return
+	}
+	if v, ok, overflow := _parseInt([]byte(g.addr)); ok {
+		g.kind, g.i, g.f = addrInt, v, float64(v)
+		return
+	} else if overflow {
+		g.err = ErrIntegerRange
+	} else {
+		g.err = ErrValueSyntax
+	}
+	if v, err := strconv.ParseFloat(g.addr, 64); err == nil {
+		g.kind, g.f = addrFloat, v
+	} else {
+		g.kind = addrText
+	}
+}
+
+// Float returns the addr as a number, ok is false if it is not
+func (g *Gcode) Float() (v float64, ok bool) {
+	g.parse()
+	return g.f, g.kind == addrFloat || g.kind == addrInt
+}
+
+// Int returns the addr as an integer, ok is false if it is not, e.g. "1.5"
+func (g *Gcode) Int() (v int64, ok bool) {
+	g.parse()
+	return g.i, g.kind == addrInt
+}
+
 func (g *Gcode) AddrAs(target any) error {
-	baddr := []byte(g.addr)
 	switch typ := target.(type) {
 	case *string:
 		*typ = g.addr
-	case *int:
-		i64, err := ParseInt(baddr)
-		if err == nil {
-			*typ = int(i64)
+	case *int, *int32, *int64:
+		i, ok := g.Int()
+		if !ok {
+			return g.err
+		}
+		switch typ := typ.(type) {
+		case *int:
+			*typ = int(i)
+		case *int32:
+			*typ = int32(i)
+		case *int64:
+			*typ = i
 		}
-		return err
-	case *int32:
-		i64, err := ParseInt(baddr)
-		if err == nil {
-			*typ = int32(i64)
+	case *float32, *float64:
+		f, ok := g.Float()
+		if !ok {
+			_, err := strconv.ParseFloat(g.addr, 64)
+			return err
 		}
-		return err
-	case *float32:
-		f64, err := strconv.ParseFloat(g.addr, 32)
-		if err == nil {
-			*typ = float32(f64)
+		switch typ := typ.(type) {
+		case *float32:
+			*typ = float32(f)
+		case *float64:
+			*typ = f
 		}
-		return err
 	default:
 		return fmt.Errorf("unsupported addr type as %T", typ)
 	}
 	return nil
 }
 
+// formatFloat formats v by the precision of the word, without "-0"
+func formatFloat(word byte, v float64) string {
+	decimals, ok := Precision[word]
+	if !ok {
+		decimals = DefaultPrecision
+	}
+	if math.Abs(v) < 0.5*math.Pow10(-decimals) {
+		v = 0
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+// SetAddr sets the addr, the floats are formatted by Precision
 func (g *Gcode) SetAddr(value any) error {
 	switch typ := value.(type) {
 	case string:
-		g.addr = strings.TrimSpace(typ)
-	case int, int32, int64, uint, uint32, uint64:
-		g.addr = fmt.Sprintf("%d", typ)
-	case float32, float64:
-		var (
-			v64 float64
-			ok  bool
-		)
-		if v64, ok = value.(float64); !ok {
-			v32, _ := value.(float32)
-			v64 = float64(v32)
-		}
-
-		switch g.Word() {
-		case 'E':
-			switch {
-			case math.Abs(v64) < 0.00001:
-				g.addr = "0.00000"
-			default:
-				g.addr = fmt.Sprintf("%.5f", v64)
-			}
-		default:
-			switch {
-			case math.Abs(v64) < 0.001:
-				g.addr = "0.000"
-			default:
-				g.addr = fmt.Sprintf("%.3f", v64)
-			}
-		}
+		g.addr, g.kind = strings.TrimSpace(typ), addrUnparsed
+	case int:
+		g.setInt(int64(typ))
+	case int32:
+		g.setInt(int64(typ))
+	case int64:
+		g.setInt(typ)
+	case uint, uint32, uint64:
+		g.addr, g.kind = fmt.Sprintf("%d", typ), addrUnparsed
+	case float32:
+		g.addr, g.kind = formatFloat(g.word, float64(typ)), addrUnparsed
+	case float64:
+		g.addr, g.kind = formatFloat(g.word, typ), addrUnparsed
 	case nil:
-		g.addr = ""
+		g.addr, g.kind = "", addrUnparsed
 	default:
 		return fmt.Errorf("unsupported addr type %T", typ)
 	}
 	return nil
 }
 
+func (g *Gcode) setInt(v int64) {
+	g.addr = strconv.FormatInt(v, 10)
+	g.kind, g.i, g.f = addrInt, v, float64(v)
+}
+
 // func (g *Gcode) Compare(other Gcode) bool {
 // 	return g.word == other.word && g.addr == other.addr
 // }
@@ -112,14 +171,12 @@ func (g *Gcode) Is(s string) bool {
 }
 
 func (g *Gcode) String() string {
-	return string(append([]byte{g.word}, g.addr[:]...))
+	return string(g.word) + g.addr
 }
 
 func (g *Gcode) Copy() *Gcode {
-	return &Gcode{
-		word: g.word,
-		addr: g.addr,
-	}
+	c := *g
+	return &c
 }
 
 func NewGcode(word byte, addr string) (*Gcode, error) {
@@ -140,8 +197,14 @@ func ParseGcode(s string) (*Gcode, error) {
 type GcodeBlock struct {
 	cmd     *Gcode
 	params  []*Gcode
+	text    string // argument of the string commands, e.g. M117
 	comment string
 	next    *GcodeBlock
+
+	num      int64  // line number N
+	numbered bool   // has N
+	checksum string // * after N, empty if none
+	summed   string // code of the checksum, the checksum is recomputed if the code is changed since
 }
 
 func (b *GcodeBlock) Cmd() *Gcode {
@@ -158,6 +221,61 @@ func (b *GcodeBlock) Params() []*Gcode {
 	return b.params
 }
 
+// Text returns the string argument of M23/M28/M32/M117/M118
+func (b *GcodeBlock) Text() string {
+	return b.text
+}
+
+func (b *GcodeBlock) SetText(text string) {
+	b.text = strings.TrimSpace(text)
+}
+
+// LineNumber returns N of the line, ok is false if there is none
+func (b *GcodeBlock) LineNumber() (n int64, ok bool) {
+	return b.num, b.numbered
+}
+
+// SetLineNumber sets N of the line and its checksum
+func (b *GcodeBlock) SetLineNumber(n int64) {
+	b.num, b.numbered = n, true
+	b.summed = b.code()
+	b.checksum = strconv.Itoa(int(checksum(b.summed)))
+}
+
+// Checksum returns the checksum after N as it is written, it is not checked,
+// but it is recomputed if the line is changed, e.g. by SetParam
+func (b *GcodeBlock) Checksum() string {
+	if b.checksum == "" {
+		return ""
+	}
+	return b.checksumOf(b.code())
+}
+
+// checksumOf returns the checksum of the code of the line
+func (b *GcodeBlock) checksumOf(code string) string {
+	if code == b.summed {
+		return b.checksum
+	}
+	return strconv.Itoa(int(checksum(code)))
+}
+
+// code returns the line without the checksum and the comment
+func (b *GcodeBlock) code() string {
+	s := strings.TrimSpace(b.Format("%c %p"))
+	if b.numbered {
+		s = fmt.Sprintf("N%d %s", b.num, s)
+	}
+	return s
+}
+
+// checksum is XOR of the bytes before "*"
+func checksum(s string) (cs byte) {
+	for i := 0; i < len(s); i++ {
+		cs ^= s[i]
+	}
+	return cs
+}
+
 func (b *GcodeBlock) Comment() string {
 	return b.comment
 }
@@ -182,7 +300,17 @@ func (b *GcodeBlock) AppendComment(comment string, args ...any) {
 }
 
 func (b *GcodeBlock) String() string {
-	return strings.TrimSpace(b.Format("%c %p %m"))
+	if !b.numbered {
+		return strings.TrimSpace(b.Format("%c %p %m"))
+	}
+	s := b.code()
+	if b.checksum != "" {
+		s += "*" + b.checksumOf(s)
+	}
+	if b.comment != "" {
+		s += " " + b.comment
+	}
+	return s
 }
 
 func (b *GcodeBlock) IsComment() bool {
@@ -227,32 +355,50 @@ func (b *GcodeBlock) SetParam(p byte, v string) error {
 	return err
 }
 
-func (b *GcodeBlock) GetParam(p byte, target any) error {
+// param returns the param p, nil if there is none
+func (b *GcodeBlock) param(p byte) *Gcode {
 	for _, g := range b.Params() {
 		if g.Word() == p {
-			return g.AddrAs(target)
+			return g
 		}
 	}
+	return nil
+}
+
+func (b *GcodeBlock) GetParam(p byte, target any) error {
+	if g := b.param(p); g != nil {
+		return g.AddrAs(target)
+	}
 	return fmt.Errorf("param %s not found", string(p))
 }
 
 func (b *GcodeBlock) GetToolNum() (t int32, err error) {
 	t = -1
+	var tool *Gcode
 	switch b.Cmd().Word() {
 	case 'T': // Tn
-		err = b.Cmd().AddrAs(&t)
+		tool = b.Cmd()
 	case 'M':
+		p := byte('T')
 		switch b.Cmd().Addr() {
 		case "106", "107":
-			err = b.GetParam('P', &t)
+			p = 'P'
 		case "301", "303":
-			err = b.GetParam('E', &t)
-		default:
-			err = b.GetParam('T', &t)
+			p = 'E'
+		}
+		if tool = b.param(p); tool == nil {
+			err = fmt.Errorf("param %s not found", string(p))
 		}
 	default:
 		err = fmt.Errorf("command %s not supported", b.Cmd())
 	}
+	if tool != nil {
+		if v, ok := tool.Int(); ok {
+			t = int32(v)
+		} else {
+			err = tool.err
+		}
+	}
 	if (t == -1 || err != nil) && len(b.Comment()) > 2 {
 		// try T in comment
 		if ele := strings.TrimSpace(take(b.Comment(), `\s*T\d+`).taken); ele != "" {
@@ -287,7 +433,9 @@ func (b *GcodeBlock) Format(format string) string {
 					}
 					i++
 				case 'p':
-					if total := len(b.Params()); total > 0 {
+					if b.text != "" {
+						result.WriteString(b.text)
+					} else if total := len(b.Params()); total > 0 {
 						for i, g := range b.Params() {
 							result.WriteString(g.String())
 							if i < total-1 {
@@ -311,69 +459,230 @@ func (b *GcodeBlock) Format(format string) string {
 
 func (b *GcodeBlock) Copy() *GcodeBlock {
 	params := make([]*Gcode, len(b.Params()))
-	copy(params, b.Params())
+	for i, p := range b.Params() {
+		params[i] = p.Copy()
+	}
 	return &GcodeBlock{
-		cmd:     b.Cmd().Copy(),
-		params:  params,
-		comment: b.Comment(),
+		cmd:      b.Cmd().Copy(),
+		params:   params,
+		text:     b.text,
+		comment:  b.Comment(),
+		num:      b.num,
+		numbered: b.numbered,
+		checksum: b.checksum,
+		summed:   b.summed,
 	}
 }
 
-func ParseGcodeBlock(source string) (*GcodeBlock, error) {
-	if len(source) > 0 && source[0] == ' ' {
-		source = strings.TrimSpace(source)
+// stringCommands take the rest of the line as a string, e.g. M117 Hello world
+var stringCommands = map[string]bool{"M23": true, "M28": true, "M32": true, "M117": true, "M118": true}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// skipQuoted returns the index after the string which starts at i, "" in a string is a quote
+func skipQuoted(s string, i int) int {
+	for i++; i < len(s); i++ {
+		if s[i] == '"' {
+			if i+1 < len(s) && s[i+1] == '"' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+// splitComment returns the code and the comment of the line, the comments in parentheses are moved to the comment,
+// e.g. "G1 X1 (move) ; to X1" -> "G1 X1", ";(move) ; to X1"
+func splitComment(source string) (code, comment string) {
+	if strings.IndexAny(source, `"(`) == -1 {
+		if i := strings.IndexByte(source, ';'); i != -1 {
+			return source[:i], strings.TrimSpace(source[i:])
+		}
+		return source, ""
+	}
+
+	var (
+		sb     strings.Builder
+		parens []string
+	)
+	for i := 0; i < len(source); {
+		switch source[i] {
+		case '"':
+			j := skipQuoted(source, i)
+			sb.WriteString(source[i:j])
+			i = j
+		case '(':
+			j := strings.IndexByte(source[i:], ')')
+			if j == -1 {
+				j = len(source) - i - 1
+			}
+			parens = append(parens, strings.TrimSpace(source[i:i+j+1]))
+			sb.WriteByte(' ')
+			i += j + 1
+		case ';':
+			comment = strings.TrimSpace(source[i:])
+			i = len(source)
+		default:
+			sb.WriteByte(source[i])
+			i++
+		}
+	}
+	if len(parens) > 0 {
+		if comment != "" {
+			parens = append(parens, comment)
+		}
+		comment = ";" + strings.Join(parens, " ")
+	}
+	return sb.String(), comment
+}
+
+/*
+splitText splits the line of a string command, e.g. M117 Hello; world, the argument is taken as it is,
+even if it has ";" or parentheses. ok is false for the other commands.
+
+code is the command with the line number and checksum if the line is numbered, the checksum is the last
+"*" and digits of a numbered line, which may be followed by a comment.
+*/
+func splitText(source string) (code, text, comment string, ok bool) {
+	i := 0
+	if len(source) > 1 && (source[0] == 'N' || source[0] == 'n') && source[1] >= '0' && source[1] <= '9' {
+		for i = 1; i < len(source) && source[i] >= '0' && source[i] <= '9'; i++ {
+		}
+		for i < len(source) && isSpace(source[i]) {
+			i++
+		}
+	}
+	j := i
+	for j < len(source) && !isSpace(source[j]) {
+		j++
+	}
+	if !stringCommands[strings.ToUpper(source[i:j])] {
+		return source, "", "", false
+	}
+	code, text = source[:j], source[j:]
+
+	if i > 0 {
+		if k := strings.LastIndexByte(text, '*'); k != -1 {
+			d := k + 1
+			for d < len(text) && text[d] >= '0' && text[d] <= '9' {
+				d++
+			}
+			if rest := strings.TrimSpace(text[d:]); d > k+1 && (rest == "" || rest[0] == ';') {
+				code, text, comment = code+text[k:d], text[:k], rest
+			}
+		}
 	}
+	return code, strings.TrimSpace(text), comment, true
+}
 
+// splitLineNumber returns the line number N and the checksum * of the code, ok is false if there is no line number
+func splitLineNumber(code string) (n int64, checksum, rest string, ok bool) {
+	if len(code) < 2 || (code[0] != 'N' && code[0] != 'n') || code[1] < '0' || code[1] > '9' {
+		return 0, "", code, false
+	}
+	i := 1
+	for i < len(code) && code[i] >= '0' && code[i] <= '9' {
+		i++
+	}
+	if i < len(code) && !isSpace(code[i]) {
+		return 0, "", code, false // e.g. N1X
+	}
+	n, err := strconv.ParseInt(code[1:i], 10, 64)
+	if err != nil {
+		return 0, "", code, false
+	}
+	rest = strings.TrimSpace(code[i:])
+	if rest == "" {
+		return 0, "", code, false // N as the command
+	}
+	if j := strings.LastIndexByte(rest, '*'); j != -1 {
+		cs := strings.TrimSpace(rest[j+1:])
+		if _, err := strconv.ParseUint(cs, 10, 8); err == nil {
+			checksum, rest = cs, strings.TrimSpace(rest[:j])
+		}
+	}
+	return n, checksum, rest, true
+}
+
+/*
+ParseGcodeBlock parses a line of RS274/Marlin gcode:
+
+  - words are separated by spaces, the letters are case insensitive, e.g. "g1 x10" is "G1 X10"
+  - the comment starts at ";", the comments in parentheses are moved to it
+  - a line number "N123" at the start and a checksum "*45" at the end
+  - the argument of M23, M28, M32, M117 and M118 is a string, kept as it is with its ";" and parentheses
+  - strings in quotes are kept as they are, e.g. M98 P"0:/macros/file name.g"
+
+The words which are not a letter are dropped.
+*/
+func ParseGcodeBlock(source string) (*GcodeBlock, error) {
+	source = strings.TrimSpace(source)
 	if source == "" {
 		return nil, ErrEmptyString
 	}
 
 	block := &GcodeBlock{}
-
-	// keep comments
-	if i := strings.Index(source, ";"); i != -1 {
-		comments := source[i:]
-		source = source[:i]
-		block.SetComment(strings.TrimSpace(comments))
+	code, text, comment, isText := splitText(source)
+	if !isText {
+		code, comment = splitComment(source)
 	}
+	block.comment = comment
 
-	parse := prepareGcodeLineToParse(source)
-
-	if parse == "" {
+	code = strings.TrimSpace(code)
+	if n, checksum, rest, ok := splitLineNumber(code); ok {
+		block.num, block.numbered, block.checksum = n, true, checksum
+		code = rest
+	}
+	if code == "" {
+		if block.checksum != "" {
+			block.summed = block.code()
+		}
 		return block, nil // only comments
 	}
 
 	params := make([]*Gcode, 0, 8)
-
-	total := len(parse)
-	for i := 0; i < total; {
-		start := i
-		for i < total && parse[i] != ' ' {
+	for i := 0; i < len(code); {
+		for i < len(code) && isSpace(code[i]) {
 			i++
 		}
-		g := parse[start:i]
-
-		if g == "" {
+		start := i
+		for i < len(code) && !isSpace(code[i]) {
+			if code[i] == '"' {
+				i = skipQuoted(code, i)
+			} else {
+				i++
+			}
+		}
+		if start == i {
 			continue
 		}
-		if err := isValidWord(g[0]); err == nil {
-			gcode, err := ParseGcode(g)
-			if err != nil {
-				return nil, err
-			}
 
-			params = append(params, gcode)
+		word := code[start]
+		if word >= 'a' && word <= 'z' {
+			word -= 'a' - 'A'
 		}
-
-		for i < total && parse[i] == ' ' {
-			i++
+		if err := isValidWord(word); err != nil {
+			continue
 		}
+		gcode, err := NewGcode(word, code[start+1:i])
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, gcode)
 	}
+	block.text = text
 
 	if len(params) > 0 {
 		block.cmd = params[0]
 		block.params = params[1:]
 	}
+	if block.checksum != "" {
+		block.summed = block.code()
+	}
 
 	return block, nil
 }
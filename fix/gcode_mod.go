@@ -1,16 +1,19 @@
 package fix
 
 import (
-	"bytes"
 	"fmt"
-	"strconv"
-	"strings"
 	"sync"
 )
 
+// GcodeModifier is the old-style modifier, use Adapt to run it in a Pipeline
 type GcodeModifier func([]*GcodeBlock) []*GcodeBlock
 
-func GcodeFixShutoff(gcodes []*GcodeBlock) (output []*GcodeBlock) {
+func GcodeFixShutoff(gcodes []*GcodeBlock) []*GcodeBlock {
+	output, _ := fixShutoff(NewContext(Params, nil), gcodes)
+	return output
+}
+
+func fixShutoff(ctx *Context, gcodes []*GcodeBlock) (output []*GcodeBlock, err error) {
 	nGcodes := len(gcodes)
 	output = make([]*GcodeBlock, 0, nGcodes+8)
 
@@ -40,27 +43,27 @@ func GcodeFixShutoff(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 
 	// add M104 S0
 	var (
-		curTool int32 = -1
-		offset  int
+		state  = NewMachineState()
+		offset int
 	)
 	for n, line := range gcodes {
 		output = append(output, line)
 		cmd := line.Cmd()
 
-		if cmd.Word() == 'T' {
-			var nextTool int32
-			cmd.AddrAs(&nextTool)
+		curTool := state.Tool
+		state.Update(line)
 
-			if curTool != -1 && curTool != nextTool {
+		if cmd.Word() == 'T' {
+			if nextTool := state.Tool; curTool != -1 && curTool != nextTool {
 				if toolLastLine[curTool] < n {
 					if g, err := ParseGcodeBlock(fmt.Sprintf("M104 S0 T%d ; (Fixed: Shutoff T%d)", curTool, curTool)); err == nil {
 						output = append(output, g)
 						toolShutted[curTool] = true
 						offset++
+						ctx.Record(n, "shutoff T%d", curTool)
 					}
 				}
 			}
-			curTool = nextTool
 		}
 
 		// M104 or M109
@@ -80,12 +83,14 @@ func GcodeFixShutoff(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 							output[i] = g
 						}
 					}
+					ctx.Record(n, "T%d has been shutted off: %s", tool, line.Format("%c %p"))
 				}
 			}
 		}
 	}
 
-	return output
+	checkColdExtrusion(ctx, output)
+	return output, nil
 }
 
 var (
@@ -93,7 +98,29 @@ var (
 	PreheatLong  int64 = 3
 )
 
+// GcodeFixPreheat is the pre-heat by M73 remaining times, see fixPreheatTime for the time-based one
 func GcodeFixPreheat(gcodes []*GcodeBlock) []*GcodeBlock {
+	output, _ := fixPreheatM73(NewContext(Params, nil), gcodes)
+	return output
+}
+
+// fixPreheat uses the estimated time by default, "preheat.mode=m73" for the old behavior
+func fixPreheat(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	switch mode := ctx.Options.Str("preheat.mode", "time"); mode {
+	case "time":
+		return fixPreheatTime(ctx, gcodes)
+	case "m73":
+		return fixPreheatM73(ctx, gcodes)
+	default:
+		return nil, fmt.Errorf("unknown preheat.mode %q", mode)
+	}
+}
+
+func fixPreheatM73(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	var (
+		preheatShort = int64(ctx.Options.Int("preheat.short", int(PreheatShort)))
+		preheatLong  = int64(ctx.Options.Int("preheat.long", int(PreheatLong)))
+	)
 	hasM73 := false // must enable "Supports remaining times" in the Printer settings
 	for n, gcode := range gcodes {
 
@@ -129,9 +156,9 @@ func GcodeFixPreheat(gcodes []*GcodeBlock) []*GcodeBlock {
 							} else if remaining != remain {
 								remaining = remain
 								remainingDiffCount++
-								if remainingDiffCount == PreheatShort {
+								if remainingDiffCount == preheatShort {
 									nShortPreheat = pn
-								} else if remainingDiffCount == PreheatLong {
+								} else if remainingDiffCount == preheatLong {
 									nLongPreheat = pn
 								}
 							}
@@ -145,21 +172,24 @@ func GcodeFixPreheat(gcodes []*GcodeBlock) []*GcodeBlock {
 								// build preheat command
 								preheat, _ := ParseGcodeBlock(fmt.Sprintf("M104 T%d S%g", checkTool, preheatTemp))
 
-								if remainingDiffCount < PreheatShort {
+								if remainingDiffCount < preheatShort {
 									nl, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: remove cooldown: %s)", checkLine.Format("%c %p")))
 									gcodes[pn] = nl
-								} else if remainingDiffCount < PreheatLong {
+									ctx.Record(pn, "remove cooldown of T%d", tool)
+								} else if remainingDiffCount < preheatLong {
 									preheat.SetComment(";(Fixed: pre-heat short)")
 									// output = append(output[:nShortPreheat], append([]*GcodeBlock{preheat}, output[nShortPreheat:]...)...)
 									insertBefore(&gcodes, nShortPreheat, preheat)
+									ctx.Record(nShortPreheat, "pre-heat short T%d", tool)
 								} else {
 									preheat.SetComment(";(Fixed: pre-heat long)")
 									// output = append(output[:nLongPreheat], append([]*GcodeBlock{preheat}, output[nLongPreheat:]...)...)
 									insertBefore(&gcodes, nLongPreheat, preheat)
+									ctx.Record(nLongPreheat, "pre-heat long T%d", tool)
 
 									deepfreeze, _ := ParseGcodeBlock(fmt.Sprintf(
-										"M104 T%d S110 ;(Fixed: deep freeze instead of: %s)",
-										tool, checkLine.Format("%c %p")))
+										"M104 T%d S%g ;(Fixed: deep freeze instead of: %s)",
+										tool, deepFreezeTemp(ctx, tool), checkLine.Format("%c %p")))
 									gcodes[pn] = deepfreeze
 								}
 							}
@@ -174,10 +204,28 @@ func GcodeFixPreheat(gcodes []*GcodeBlock) []*GcodeBlock {
 
 	if !hasM73 {
 		// Do not modify anything if there is no M73
-		return gcodes
+		ctx.Warnf("no M73 found, enable \"Supports remaining times\" in the printer settings")
+		return gcodes, nil
+	}
+
+	return removeRedundantTemps(ctx, gcodes), nil
+}
+
+// deepFreezeTemp is "preheat.deepfreeze", or by the material of the tool, 110 if unknown
+func deepFreezeTemp(ctx *Context, tool int32) float64 {
+	if v := ctx.Options.Float("preheat.deepfreeze", 0); v > 0 {
+		return v
+	}
+	if int(tool) < len(ctx.Params.FilamentTypes) {
+		if m, ok := Materials.Lookup(ctx.Params.FilamentTypes[tool]); ok && m.DeepFreezeTemp() > 0 {
+			return m.DeepFreezeTemp()
+		}
 	}
+	return 110
+}
 
-	// remove any unnecessary M104 and 109 commands
+// removeRedundantTemps removes any unnecessary M104 and 109 commands
+func removeRedundantTemps(ctx *Context, gcodes []*GcodeBlock) []*GcodeBlock {
 	curToolTemp := make(map[int32]float32)
 	curToolTempGuaranteed := make(map[int32]bool)
 	for n, line := range gcodes {
@@ -197,10 +245,12 @@ func GcodeFixPreheat(gcodes []*GcodeBlock) []*GcodeBlock {
 				case "104":
 					requested, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: already requested temp: %s)", line.Format("%c %p")))
 					gcodes[n] = requested
+					ctx.Record(n, "already requested temp T%d", tool)
 				case "109":
 					if curToolTempGuaranteed[tool] {
 						stabilized, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: already stabilized temp: %s)", line.Format("%c %p")))
 						gcodes[n] = stabilized
+						ctx.Record(n, "already stabilized temp T%d", tool)
 					} else {
 						curToolTempGuaranteed[tool] = true
 					}
@@ -232,168 +282,35 @@ func GcodeTrimLines(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 }
 */
 
-func GcodeReinforceTower(gcodes []*GcodeBlock) (output []*GcodeBlock) {
-	output = make([]*GcodeBlock, 0, len(gcodes)+2048)
-
-	var (
-		wiping bool
-		e      float32
-		f      float32
-		cmd    *GcodeBlock
-		z      float32
-	)
-	for _, gcode := range gcodes {
-		if gcode.IsComment() {
-			if gcode.InComment("; CP TOOLCHANGE WIPE") {
-				wiping = true
-			}
-			if gcode.InComment("; CP TOOLCHANGE END") {
-				wiping = false
-				e = 0.0
-			}
-			if ele := take(gcode.Comment(), `^;Z:[\d\.]+`).taken; ele != "" {
-				if v, err := strconv.ParseFloat(ele[3:], 32); err == nil {
-					z = float32(v)
-				}
-			}
-		}
-		if wiping && z > 0.3 {
-			if gcode.Is("G1") && gcode.HasParam('E') && gcode.HasParam('F') {
-				if e < 0.01 {
-					gcode.GetParam('E', &e)
-					gcode.GetParam('F', &f)
-					if e > 0.0 {
-						e = e * 0.45
-					}
-					// if f > 0.0 {
-					// 	f = f * 0.7
-					// }
-				}
-				cmd, _ = ParseGcodeBlock(fmt.Sprintf("G1 E%g F%g ;(Fixed: reinforce tower)", e, f))
-				output = append(output, cmd)
-			}
-		}
-		output = append(output, gcode)
-	}
+func GcodeReinforceTower(gcodes []*GcodeBlock) []*GcodeBlock {
+	output, _ := reinforceTower(NewContext(Params, nil), gcodes)
 	return output
 }
 
-// GcodeReplaceToolNum 查找 Gcode 中的 T/M104/M106/M107/M109 指令，将参数中的 Tnum/Pnum 替换为 num % 2 的结果
+// GcodeReplaceToolNum 查找 Gcode 中的 T/M104/M106/M107/M109 指令，将参数中的 Tnum/Pnum 替换为 num % 2 的结果，
+// 使用 "toolmap" 选项可以指定映射，见 replaceToolNum
 // Snapmaker 打印机最多只有2个喷嘴，T > 1 无效，但在 OrcaSlicer 中可以简化多材料的配置
 // T0 -> T0, T1 -> T1
 // T2 -> T0, T3 -> T1
 // T4 -> T0, T5 -> T1
-func GcodeReplaceToolNum(gcodes []*GcodeBlock) (output []*GcodeBlock) {
-	var (
-		idxT0, idxT1 int
-	)
-	nGcodes := len(gcodes)
-	work := func(wi, wn int) {
-		for n := wi; n < nGcodes; n += wn {
-			gcode := gcodes[n]
-			switch gcode.Cmd().Word() {
-			case 'T':
-				{
-					tool, _ := gcode.GetToolNum()
-					if num, t := tool%2, int(tool); num == 0 {
-						idxT0 = t
-					} else {
-						idxT1 = t
-					}
-					gcodes[n].Cmd().SetAddr(tool % 2)
-				}
-			case 'M':
-				{
-					tool, _ := gcode.GetToolNum()
-					str_tool := strconv.Itoa(int(tool) % 2)
-					switch gcode.Cmd().Addr() {
-					case "106", "107": // fan use P
-						if gcode.HasParam('P') {
-							gcodes[n].SetParam('P', str_tool)
-						}
-
-					case "104", "109": // temp use T
-						if gcode.HasParam('T') {
-							gcodes[n].SetParam('T', str_tool)
-						}
-
-					case "301", "303":
-						if gcode.HasParam('E') {
-							gcodes[n].SetParam('E', str_tool)
-						}
-
-					}
-				} // M
-			} // switch word
-		} // for
-	} // work
-
-	GoInParallelAndWait(work)
+func GcodeReplaceToolNum(gcodes []*GcodeBlock) []*GcodeBlock {
+	output, _ := replaceToolNum(NewContext(Params, nil), gcodes)
+	return output
+}
 
-	// remove unused values for ParseParams()
-	prefixes := []string{
-		"; filament used [",
-		"; filament_type = ",
-		"; filament_retraction_length = ",
-		"; nozzle_temperature_initial_layer = ",
-		"; hot_plate_temp_initial_layer = ",
-	}
-	work2 := func(wi, wn int) {
-		defer func() {
-			if r := recover(); r != nil {
-				// fmt.Println(r, comment)
-			}
-		}()
-		for n := wi; n < nGcodes; n += wn {
-			gcode := gcodes[n]
-			if gcode.IsComment() {
-				comment := gcode.Comment()
-				if len(comment) > 15 {
-					for _, prefix := range prefixes {
-						if strings.HasPrefix(comment, prefix) {
-							i := strings.Index(comment, "=")
-							if i != -1 {
-								v := comment[i+1:]
-								var (
-									vs        []string
-									delimiter = ","
-								)
-								if strings.Contains(v, ";") {
-									delimiter = ";"
-								}
-								vs = strings.Split(v, delimiter)
-								l := len(vs)
-								if l >= idxT0 {
-									vs[0] = strings.TrimSpace(vs[idxT0])
-								}
-								if l >= idxT1 {
-									vs[1] = strings.TrimSpace(vs[idxT1])
-								}
-								nv := strings.Join(vs[:2], delimiter)
-								var buf bytes.Buffer
-								buf.WriteString(comment[:i+2])
-								buf.WriteString(nv)
-								gcodes[n].SetComment(buf.String())
-							}
-							break
-						}
-					}
-				}
-			}
-		}
-	}
-	GoInParallelAndWait(work2)
-	return gcodes
+func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) []*GcodeBlock {
+	output, _ := fixOrcaToolUnload(NewContext(Params, nil), gcodes)
+	return output
 }
 
-func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) (output []*GcodeBlock) {
+func fixOrcaToolUnload(ctx *Context, gcodes []*GcodeBlock) (output []*GcodeBlock, err error) {
 	output = make([]*GcodeBlock, 0, len(gcodes)+2048)
 
 	var (
 		check bool
 		cmd   *GcodeBlock
 	)
-	for _, gcode := range gcodes {
+	for n, gcode := range gcodes {
 		if gcode.IsComment() {
 			if gcode.InComment("; CP TOOLCHANGE START") {
 				check = true
@@ -407,10 +324,11 @@ func GcodeFixOrcaToolUnload(gcodes []*GcodeBlock) (output []*GcodeBlock) {
 			if _, err := gcode.GetToolNum(); err != nil {
 				cmd, _ = ParseGcodeBlock(fmt.Sprintf(";(Fixed: remove: %s)", gcode.Format("%c %p")))
 				output = append(output, cmd)
+				ctx.Record(n, "remove: %s", gcode.Format("%c %p"))
 				continue
 			}
 		}
 		output = append(output, gcode)
 	}
-	return output
+	return output, nil
 }
@@ -1,7 +1,9 @@
 package fix
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 )
 
 func H(s string, p ...any) []byte {
@@ -19,7 +21,8 @@ func headerV0() [][]byte {
 	h = append(h, H(";header_type: 3dp"))
 	h = append(h, H(";tool_head: %s", Params.ToolHead))
 	h = append(h, H(";machine: %s", Params.Model))
-	h = append(h, H(";file_total_lines: %d", Params.TotalLines+34))
+	h = append(h, nil) // file_total_lines, see countLines
+	total := len(h) - 1
 	h = append(h, H(";estimated_time(s): %.0f", float64(Params.EstimatedTimeSec)*1.07))
 	// h = append(h, H(";nozzle_temperature(°C): %.0f", Params.EffectiveNozzleTemperature()))
 	h = append(h, H(";nozzle_temperature(°C): %.0f", Params.NozzleTemperatures[0]))
@@ -45,12 +48,16 @@ func headerV0() [][]byte {
 	h = append(h, H(";layer_height: %.2f", Params.LayerHeight))
 	h = append(h, H(";matierial_weight: %.4f", Params.AllFilamentUsedWeight()))
 	h = append(h, H(";matierial_length: %.5f", Params.AllFilamentUsed()/1000.0))
+	if len(Params.ColorSequence) > 0 {
+		h = append(h, H(";color_sequence: %s", strings.Join(Params.ColorSequence, " > ")))
+	}
 
 	if len(Params.Thumbnail) > 0 {
 		h = append(h, H(";thumbnail: %s", Params.Thumbnail))
 	}
 
 	h = append(h, H(";Header End\n\n"))
+	h[total] = H(";file_total_lines: %d", countLines(h)+Params.TotalLines)
 	return h
 }
 
@@ -61,7 +68,8 @@ func headerV1() [][]byte {
 	h = append(h, H(";Version:1"))
 	h = append(h, H(";Printer:%s", Params.Model))
 	h = append(h, H(";Estimated Print Time:%d", Params.EstimatedTimeSec))
-	h = append(h, H(";Lines:%d", Params.TotalLines+27))
+	h = append(h, nil) // Lines, see countLines
+	total := len(h) - 1
 	h = append(h, H(";Extruder Mode:%s", Params.PrintMode))
 	h = append(h, H(";Extruder 0 Nozzle Size:%.1f", Params.NozzleDiameters[0]))
 	h = append(h, H(";Extruder 0 Material:%s", Params.FilamentTypes[0]))
@@ -87,23 +95,41 @@ func headerV1() [][]byte {
 		h = append(h, H(";Extruder(s) Used:1"))
 	}
 
+	if len(Params.ColorSequence) > 0 {
+		h = append(h, H(";Color Sequence:%s", strings.Join(Params.ColorSequence, " > ")))
+	}
+
 	if len(Params.Thumbnail) > 0 {
 		h = append(h, H(";Thumbnail:%s", Params.Thumbnail))
 	}
 
 	h = append(h, H(";Header End\n\n"))
+	h[total] = H(";Lines:%d", countLines(h)+Params.TotalLines)
 	return h
 }
 
-func ExtractHeader(gcodes []*GcodeBlock) (headers [][]byte, err error) {
-	if err = ParseParams(gcodes); err != nil {
-		return
+// countLines returns the lines of the header as it is written, the line of the count is a line too
+func countLines(h [][]byte) int {
+	n := len(h) - 1 // joined by "\n"
+	for _, b := range h {
+		n += bytes.Count(b, []byte("\n"))
 	}
+	return n
+}
 
+// Header returns the header of the current Params
+func Header() [][]byte {
 	if Params.Version == 1 {
-		headers = headerV1()
-	} else {
-		headers = headerV0()
+		return headerV1()
+	}
+	return headerV0()
+}
+
+// ExtractHeader parses the params of the gcodes, and returns the header for them, see WriteGcode
+func ExtractHeader(gcodes []*GcodeBlock) (headers [][]byte, err error) {
+	if err = ParseParams(gcodes); err != nil {
+		return
 	}
-	return
+	Params.TotalLines = len(gcodes) // as they are written
+	return Header(), nil
 }
@@ -0,0 +1,244 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type idexMode struct {
+	PrintMode string
+	Setup     []string // commands to set the mode
+	HalfBed   bool     // each head prints on a half of the bed
+}
+
+// IdexModes are the print modes of J1 which a single extruder file can be converted to, by "idex.mode"
+var IdexModes = map[string]idexMode{
+	"duplication": {PrintModeDuplication, []string{"M605 S2"}, true},
+	"mirror":      {PrintModeMirror, []string{"M605 S3"}, true},
+	// T1 takes over when the filament of T0 runs out
+	"backup": {PrintModeBackup, []string{"M605 S4", "M412 S1"}, false},
+}
+
+/*
+convertIdexMode converts a J1 file printed by T0 to the mode of "idex.mode",
+T1 follows the temperatures and fans of T0.
+
+In backup mode, both extruders must be loaded with the same material, T1 is "idex.backup_material",
+or the second filament_type of the slicer.
+
+In duplication and mirror modes, each head prints on a half of the bed, the part must be narrower than
+"idex.width" (160mm), and it is moved into X "idex.min_x" (0) to min_x+width if "idex.shift" (true).
+In mirror mode, the part and its mirrored copy must not overlap on the bed, see checkMirrorX.
+*/
+func convertIdexMode(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	name := strings.ToLower(ctx.Options.Str("idex.mode", ""))
+	if name == "" || name == "default" {
+		return gcodes, nil
+	}
+	mode, ok := IdexModes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown idex.mode %q", name)
+	}
+	if ctx.Params.Model != ModelJ1 {
+		return nil, fmt.Errorf("%s mode requires %s, not %q", name, ModelJ1, ctx.Params.Model)
+	}
+	if ctx.Params.PrintMode != PrintModeDefault {
+		return nil, fmt.Errorf("the file is already in %s mode", ctx.Params.PrintMode)
+	}
+	for n, g := range gcodes {
+		if t, err := g.GetToolNum(); err == nil && g.Cmd().Word() == 'T' && t != 0 {
+			return nil, fmt.Errorf("line %d: %s, only the file printed by T0 can be converted", n+1, g.Cmd())
+		}
+	}
+
+	var dx float64
+	if mode.HalfBed {
+		var err error
+		if dx, err = fitHalfBed(ctx, name, gcodes); err != nil {
+			return nil, err
+		}
+	} else if mode.PrintMode == PrintModeBackup {
+		if err := checkBackupMaterials(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		output = make([]*GcodeBlock, 0, len(gcodes)+64)
+		state  = NewMachineState()
+		setup  = -1 // line to set the mode
+		first  = 0  // shift moves in [first, last]
+		last   = -1
+	)
+	for n, g := range gcodes {
+		if setup < 0 && g.Is("G28") {
+			setup = n
+		}
+	}
+	if setup < 0 {
+		for n, g := range gcodes {
+			if !g.IsComment() && g.String() != "" {
+				setup = n
+				break
+			}
+		}
+	}
+	if dx != 0 {
+		first, last = printRange(gcodes)
+	}
+
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+
+		if n == setup {
+			for _, cmd := range mode.Setup {
+				tag, _ := ParseGcodeBlock(fmt.Sprintf("%s ;(Fixed: %s)", cmd, mode.PrintMode))
+				output = append(output, tag)
+			}
+			ctx.Record(n, "%s mode", name)
+		}
+
+		switch {
+		case n >= first && n <= last && !prev.Relative && (g.Is("G0") || g.Is("G1") || g.Is("G2") || g.Is("G3")) && g.HasParam('X'):
+			if x, ok := g.paramFloat('X'); ok {
+				g.SetParam('X', strconv.FormatFloat(math.Round((x+dx)*1000)/1000, 'f', -1, 64))
+			}
+
+		case g.Is("M104") || g.Is("M109") || g.Is("M106") || g.Is("M107"):
+			word, tool := byte('T'), prev.toolOf(g)
+			if g.Is("M106") || g.Is("M107") {
+				word, tool = 'P', 0
+				if v, ok := g.paramFloat('P'); ok {
+					tool = int32(v)
+				}
+			}
+			switch tool {
+			case -1, 0:
+				follow := g.Copy()
+				follow.SetParam(word, "1")
+				follow.SetComment(";(Fixed: T1 follows T0)")
+				if g.Is("M109") {
+					// heat both at the same time
+					heat := follow.Copy()
+					heat.Cmd().SetAddr("104")
+					output = append(output, heat, g, follow)
+				} else {
+					output = append(output, g, follow)
+				}
+				ctx.Record(n, "T1 follows T0: %s", g.Format("%c %p"))
+				continue
+			case 1:
+				removed, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: T1 follows T0, remove: %s)", g.Format("%c %p")))
+				output = append(output, removed)
+				ctx.Record(n, "remove: %s", g.Format("%c %p"))
+				continue
+			}
+		}
+		output = append(output, g)
+	}
+
+	ctx.Params.PrintMode = mode.PrintMode
+	ctx.Params.Version = 1
+	return output, nil
+}
+
+func checkBackupMaterials(ctx *Context) error {
+	var t0, t1 string
+	if types := ctx.Params.SlicerFilaments; len(types) > 1 {
+		t0, t1 = types[0], types[1]
+	} else if len(types) > 0 {
+		t0 = types[0]
+	}
+	t1 = ctx.Options.Str("idex.backup_material", t1)
+	t0, t1 = strings.TrimSpace(t0), strings.TrimSpace(t1)
+	switch {
+	case t0 == "" || t0 == "-" || t1 == "" || t1 == "-":
+		return fmt.Errorf("backup mode needs the filament types of both extruders, got %q and %q, set idex.backup_material for T1", t0, t1)
+	case !strings.EqualFold(t0, t1):
+		return fmt.Errorf("backup mode needs the same material in both extruders, T0 is %s but T1 is %s", t0, t1)
+	}
+	return nil
+}
+
+// fitHalfBed checks the width of the part, returns the offset of X to move it into the half of the bed
+func fitHalfBed(ctx *Context, name string, gcodes []*GcodeBlock) (dx float64, err error) {
+	var (
+		width = ctx.Options.Float("idex.width", 160)
+		minX  = ctx.Options.Float("idex.min_x", 0)
+		maxX  = minX + width
+	)
+	lo, hi, ok := printBoundsX(gcodes)
+	if !ok {
+		return 0, nil
+	}
+	if hi-lo > width {
+		return 0, fmt.Errorf("the part is %.1fmm wide, %s mode prints %.0fmm at most", hi-lo, name, width)
+	}
+	if lo < minX || hi > maxX {
+		if !ctx.Options.Bool("idex.shift", true) {
+			return 0, fmt.Errorf("the part (X %.1f to %.1f) is out of X %.0f to %.0f of %s mode", lo, hi, minX, maxX, name)
+		}
+		dx = math.Round(((minX+maxX)/2-(lo+hi)/2)*1000) / 1000
+		ctx.Logf("move the part by X%+g to fit %s mode", dx, name)
+	}
+	if IdexModes[name].PrintMode == PrintModeMirror {
+		if err := checkMirrorX(ctx, lo+dx, hi+dx); err != nil {
+			return 0, err
+		}
+	}
+	return dx, nil
+}
+
+/*
+checkMirrorX checks the part of T0 in X lo to hi, and its copy by T1 which is mirrored about the center of the bed,
+"idex.bed_width" (324mm). Both must be on the bed, and the copy must be on the right of the part, or the heads collide.
+*/
+func checkMirrorX(ctx *Context, lo, hi float64) error {
+	bed := ctx.Options.Float("idex.bed_width", 324)
+	mirroredLo, mirroredHi := bed-hi, bed-lo
+	switch {
+	case lo < 0 || hi > bed || mirroredLo < 0 || mirroredHi > bed:
+		return fmt.Errorf("the part (X %.1f to %.1f) is mirrored to X %.1f to %.1f, out of the bed (X 0 to %.0f)", lo, hi, mirroredLo, mirroredHi, bed)
+	case mirroredLo <= hi:
+		return fmt.Errorf("the part (X %.1f to %.1f) is mirrored to X %.1f to %.1f, the heads collide", lo, hi, mirroredLo, mirroredHi)
+	}
+	return nil
+}
+
+// printRange returns the lines from the first layer to the last extrusion
+func printRange(gcodes []*GcodeBlock) (first, last int) {
+	if layers := DetectLayers(gcodes).Layers(); len(layers) > 0 {
+		first = layers[0].StartLine
+	}
+	state := NewMachineState()
+	last = -1
+	for n, g := range gcodes {
+		e := state.E
+		state.Update(g)
+		if isExtruding(g, state.E, e) {
+			last = n
+		}
+	}
+	return
+}
+
+// printBoundsX of the extrusions in the layers
+func printBoundsX(gcodes []*GcodeBlock) (lo, hi float64, ok bool) {
+	first, last := printRange(gcodes)
+	state := NewMachineState()
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+		if n < first || n > last || !isExtruding(g, state.E, prev.E) {
+			continue
+		}
+		lo = math.Min(lo, math.Min(prev.X, state.X))
+		hi = math.Max(hi, math.Max(prev.X, state.X))
+		ok = true
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package fix
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// kinds of Injection
+const (
+	InjectAtZ         = "at"     // before the first layer at or above Z
+	InjectBeforeLayer = "before" // before the layer
+	InjectAfterLayer  = "after"  // after the layer
+	InjectEvery       = "every"  // after every N layers
+)
+
+var (
+	reInjectZ     = regexp.MustCompile(`^(?:at\s+)?z\s*=?\s*(\d+(?:\.\d*)?|\.\d+)$`)
+	reInjectLayer = regexp.MustCompile(`^(?:(before|after)\s+)?layer\s+(\d+)$`)
+	reInjectEvery = regexp.MustCompile(`^every\s+(\d+)\s+layers?$`)
+)
+
+/*
+Injection inserts commands at a layer or Z height (key "inject"), the syntax is:
+
+	trigger: command [| command ...]
+
+trigger:
+
+	at z=12.4          before the first layer at or above Z12.4, e.g. a pause at height
+	before layer 30    before the layer, layers are counted from 1
+	after layer 30     after the layer, before the next one or after the last extrusion
+	every 50 layers    after the layer 50, 100, 150...
+
+e.g. "at z=12.4: M600", "every 50 layers: G28 X Y".
+*/
+type Injection struct {
+	Source   string
+	Kind     string
+	Z        float64
+	Layer    int // from 1, or the interval of InjectEvery
+	Commands []*GcodeBlock
+}
+
+// ParseInjection compiles an injection
+func ParseInjection(source string) (*Injection, error) {
+	in := &Injection{Source: source}
+
+	trigger, commands, ok := strings.Cut(source, ":")
+	if !ok {
+		return nil, fmt.Errorf("inject %q: missing ':' after the trigger", source)
+	}
+	trigger = strings.Join(strings.Fields(strings.ToLower(trigger)), " ")
+	if m := reInjectZ.FindStringSubmatch(trigger); m != nil {
+		in.Kind = InjectAtZ
+		in.Z, _ = strconv.ParseFloat(m[1], 64)
+	} else if m := reInjectLayer.FindStringSubmatch(trigger); m != nil {
+		in.Kind = InjectBeforeLayer
+		if m[1] == InjectAfterLayer {
+			in.Kind = InjectAfterLayer
+		}
+		in.Layer, _ = strconv.Atoi(m[2])
+	} else if m := reInjectEvery.FindStringSubmatch(trigger); m != nil {
+		in.Kind = InjectEvery
+		in.Layer, _ = strconv.Atoi(m[1])
+	} else {
+		return nil, fmt.Errorf("inject %q: unknown trigger %q", source, trigger)
+	}
+	if in.Kind != InjectAtZ && in.Layer < 1 {
+		return nil, fmt.Errorf("inject %q: layers are counted from 1", source)
+	}
+
+	for _, cmd := range strings.Split(commands, "|") {
+		g, err := ParseGcodeBlock(strings.TrimSpace(cmd))
+		if err == ErrEmptyString {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inject %q: %w", source, err)
+		}
+		in.Commands = append(in.Commands, g)
+	}
+	if len(in.Commands) == 0 {
+		return nil, fmt.Errorf("inject %q: no command", source)
+	}
+	return in, nil
+}
+
+// Trigger returns the trigger in the normal form, e.g. "at Z12.4"
+func (in *Injection) Trigger() string {
+	switch in.Kind {
+	case InjectAtZ:
+		return fmt.Sprintf("at Z%g", in.Z)
+	case InjectEvery:
+		return fmt.Sprintf("every %d layers", in.Layer)
+	}
+	return fmt.Sprintf("%s layer %d", in.Kind, in.Layer)
+}
+
+// injectPoint is where to insert, before the line, and the layer (from 1) of the trigger
+type injectPoint struct {
+	line, layer int
+}
+
+// points returns where to insert the commands by the layers of the print, last is the line of the last extrusion
+func (in *Injection) points(layers []Layer, last int) (points []injectPoint) {
+	// after the layer i (from 0)
+	after := func(i int) injectPoint {
+		if i+1 < len(layers) {
+			return injectPoint{layers[i+1].StartLine, i + 1}
+		}
+		return injectPoint{last + 1, i + 1}
+	}
+	switch in.Kind {
+	case InjectAtZ:
+		for i, l := range layers {
+			if l.Z >= in.Z-1e-4 {
+				return []injectPoint{{l.StartLine, i + 1}}
+			}
+		}
+	case InjectBeforeLayer:
+		if in.Layer <= len(layers) {
+			return []injectPoint{{layers[in.Layer-1].StartLine, in.Layer}}
+		}
+	case InjectAfterLayer:
+		if in.Layer <= len(layers) {
+			return []injectPoint{after(in.Layer - 1)}
+		}
+	case InjectEvery:
+		for i := in.Layer - 1; i+1 < len(layers); i += in.Layer {
+			points = append(points, after(i))
+		}
+	}
+	return points
+}
+
+type injection struct {
+	*Injection
+	layer int
+}
+
+/*
+injectCommands inserts the commands of the "inject" options (see Injection) at the layers,
+the inserted lines are tagged with the trigger, and listed in the summary.
+*/
+func injectCommands(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	var injections []*Injection
+	for _, source := range ctx.Options.Values("inject") {
+		in, err := ParseInjection(source)
+		if err != nil {
+			return nil, err
+		}
+		injections = append(injections, in)
+	}
+	if len(injections) == 0 {
+		return gcodes, nil
+	}
+
+	var (
+		layers   = DetectLayers(gcodes)
+		_, last  = printRange(gcodes)
+		inserts  = map[int][]injection{}
+		inserted int
+	)
+	for _, in := range injections {
+		points := in.points(layers.Layers(), last)
+		if len(points) == 0 {
+			ctx.Warnf("inject %s: no such layer in %d layers", in.Trigger(), layers.Len())
+		}
+		for _, p := range points {
+			inserts[p.line] = append(inserts[p.line], injection{in, p.layer})
+			inserted += len(in.Commands)
+		}
+	}
+
+	output := make([]*GcodeBlock, 0, len(gcodes)+inserted)
+	for n := 0; n <= len(gcodes); n++ {
+		for _, in := range inserts[n] {
+			cmds := make([]string, 0, len(in.Commands))
+			for _, c := range in.Commands {
+				g := c.Copy()
+				if g.Comment() != "" {
+					g.AppendComment(" ;(Fixed: inject %s)", in.Trigger())
+				} else {
+					g.SetComment(";(Fixed: inject %s)", in.Trigger())
+				}
+				output = append(output, g)
+				cmds = append(cmds, c.String())
+			}
+			ctx.Note(n, "inject %s (layer %d): %s", in.Trigger(), in.layer, strings.Join(cmds, " | "))
+		}
+		if n < len(gcodes) {
+			output = append(output, gcodes[n])
+		}
+	}
+	return output, nil
+}
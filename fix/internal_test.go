@@ -1,11 +1,19 @@
 package fix
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
-	"reflect"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func split_(s string) (gcodes [][]byte) {
@@ -179,6 +187,19 @@ func _parseGcodes(s string) []*GcodeBlock {
 	return r
 }
 
+// _equalGcodes compares the gcodes as they are written, the params may have parsed their values or not
+func _equalGcodes(a, b []*GcodeBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
 func TestGcodeShutoff(t *testing.T) {
 	gcode := `
 T0 ; initial tool
@@ -218,7 +239,7 @@ M73 P100 R0 ; end
 	comp_gcodes := _parseGcodes(comp)
 
 	result := GcodeFixShutoff(gcodes)
-	if (reflect.DeepEqual(result, comp_gcodes)) != true {
+	if !_equalGcodes(result, comp_gcodes) {
 		results := make([]string, 0, len(result)+len(comp_gcodes)+1)
 		for _, g := range result {
 			results = append(results, g.String())
@@ -367,7 +388,7 @@ M73 P100 R0 ; end
 	comp_gcodes := _parseGcodes(comp)
 
 	result := GcodeFixPreheat(gcodes)
-	if (reflect.DeepEqual(result, comp_gcodes)) != true {
+	if !_equalGcodes(result, comp_gcodes) {
 		results := make([]string, 0, len(result)+len(comp_gcodes)+1)
 		for _, g := range result {
 			results = append(results, g.String())
@@ -497,7 +518,7 @@ G1  X176.579  E1.2970 F1584
 	comp_gcodes := _parseGcodes(comp)
 
 	result := GcodeReinforceTower(gcodes)
-	if (reflect.DeepEqual(result, comp_gcodes)) != true {
+	if !_equalGcodes(result, comp_gcodes) {
 		results := make([]string, 0, len(result)+len(comp_gcodes)+1)
 		for _, g := range result {
 			results = append(results, g.String())
@@ -553,7 +574,7 @@ func TestGcodeReplaceToolNum(t *testing.T) {
 
 	comp := func(gcodes []*GcodeBlock, want []*GcodeBlock) {
 		got := GcodeReplaceToolNum(gcodes)
-		if (reflect.DeepEqual(got, want)) != true {
+		if !_equalGcodes(got, want) {
 			results := make([]string, 0, len(got)+len(want)+1)
 			for _, g := range got {
 				results = append(results, g.String())
@@ -640,6 +661,61 @@ T1
 	})
 }
 
+func TestReplaceToolMap(t *testing.T) {
+	gcode := `
+T0
+M104 T1 S230
+G1 X1 E1
+T2
+M106 P2 S255
+G1 X2 E1
+T1
+G1 X3 E1
+; filament used [mm] = 100, 20, 30.5, 0
+; filament_type = PLA;PETG;PLA;ABS
+; nozzle_temperature_initial_layer = 210, 230, 215, 240
+`
+	cases := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"default", Options{}, `
+T0,M104 T1 S230,G1 X1 E1,T0,M106 P0 S255,G1 X2 E1,T1,G1 X3 E1
+; filament used [mm] = 130.5,20
+; filament_type = PLA;PETG
+; nozzle_temperature_initial_layer = 210,230`},
+		{"swap", Options{"toolmap": {"0:1,1:0,2:1,3:0"}}, `
+T1,M104 T0 S230,G1 X1 E1,T1,M106 P1 S255,G1 X2 E1,T0,G1 X3 E1
+; filament used [mm] = 20,130.5
+; filament_type = PETG;PLA
+; nozzle_temperature_initial_layer = 230,210`},
+	}
+	for _, c := range cases {
+		result, err := replaceToolNum(NewContext(NewParams(), c.opts), _parseGcodes(gcode))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(c.want), "\n", ","); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	errs := map[string]string{
+		"0:1,1:0":         "T2 is not in the toolmap",
+		"0:0,1:1,2:1":     "T1 prints PETG but T2 prints PLA, both are mapped to T1",
+		"0:2":             `invalid toolmap "0:2", want tool:nozzle, the nozzle is 0 or 1`,
+		"0:0,0:1":         "invalid toolmap, T0 is mapped twice",
+		"0:0,1:1,2:0,x:1": `invalid toolmap "x:1", want tool:nozzle, the nozzle is 0 or 1`,
+	}
+	for v, want := range errs {
+		_, err := replaceToolNum(NewContext(NewParams(), Options{"toolmap": {v}}), _parseGcodes(gcode))
+		if err == nil || err.Error() != want {
+			t.Errorf("toolmap %q: got error %v, want %q", v, err, want)
+		}
+	}
+}
+
 func TestGcode(t *testing.T) {
 	{ // NewGcode
 		cases := map[string]struct {
@@ -699,26 +775,26 @@ func TestGcode(t *testing.T) {
 			new    any
 			err    error
 		}{
-			{"E0.00000", &Gcode{'E', "6"}, 0.000001, nil}, // 0.000001 < 0.00001
-			{"E0.00001", &Gcode{'E', "6"}, 0.00001, nil},
-			{"E3", &Gcode{'E', ""}, 3, nil},
-			{"E4", &Gcode{'E', ""}, int32(4), nil},
-			{"E5", &Gcode{'E', ""}, int64(5), nil},
-			{"E6", &Gcode{'E', ""}, uint(6), nil},
-			{"E7", &Gcode{'E', ""}, uint32(7), nil},
-			{"E8", &Gcode{'E', ""}, uint64(8), nil},
-			{"E9.10000", &Gcode{'E', ""}, float32(9.1), nil}, // E.5f
-			{"E9.20000", &Gcode{'E', ""}, float64(9.2), nil},
-			{"R", &Gcode{'R', "999"}, nil, nil},
-			{"Z", &Gcode{'Z', "999"}, false, errors.New("unsupported addr type bool")},
-			{"S", &Gcode{'S', "999"}, errors.ErrUnsupported, errors.New("unsupported addr type *errors.errorString")},
-			{"X0.001", &Gcode{'X', ""}, 0.001, nil},
-			{"X-0.001", &Gcode{'X', ""}, -0.001, nil},
-			{"E1.23457", &Gcode{'E', ""}, 1.23456789, nil},        // E.5f
-			{"E-1.23457", &Gcode{'E', ""}, -1.23456789, nil},      // E.5f
-			{"E-1.23456789", &Gcode{'E', ""}, "-1.23456789", nil}, // string
-			{"X0.000", &Gcode{'X', "6"}, 0.0001, nil},             // 0.0001 < 0.001
-			{"X1.235", &Gcode{'X', ""}, 1.23456789, nil},          // .3f
+			{"E0.00000", &Gcode{word: 'E', addr: "6"}, 0.000001, nil}, // 0.000001 < 0.00001
+			{"E0.00001", &Gcode{word: 'E', addr: "6"}, 0.00001, nil},
+			{"E3", &Gcode{word: 'E', addr: ""}, 3, nil},
+			{"E4", &Gcode{word: 'E', addr: ""}, int32(4), nil},
+			{"E5", &Gcode{word: 'E', addr: ""}, int64(5), nil},
+			{"E6", &Gcode{word: 'E', addr: ""}, uint(6), nil},
+			{"E7", &Gcode{word: 'E', addr: ""}, uint32(7), nil},
+			{"E8", &Gcode{word: 'E', addr: ""}, uint64(8), nil},
+			{"E9.10000", &Gcode{word: 'E', addr: ""}, float32(9.1), nil}, // E.5f
+			{"E9.20000", &Gcode{word: 'E', addr: ""}, float64(9.2), nil},
+			{"R", &Gcode{word: 'R', addr: "999"}, nil, nil},
+			{"Z", &Gcode{word: 'Z', addr: "999"}, false, errors.New("unsupported addr type bool")},
+			{"S", &Gcode{word: 'S', addr: "999"}, errors.ErrUnsupported, errors.New("unsupported addr type *errors.errorString")},
+			{"X0.001", &Gcode{word: 'X', addr: ""}, 0.001, nil},
+			{"X-0.001", &Gcode{word: 'X', addr: ""}, -0.001, nil},
+			{"E1.23457", &Gcode{word: 'E', addr: ""}, 1.23456789, nil},        // E.5f
+			{"E-1.23457", &Gcode{word: 'E', addr: ""}, -1.23456789, nil},      // E.5f
+			{"E-1.23456789", &Gcode{word: 'E', addr: ""}, "-1.23456789", nil}, // string
+			{"X0.000", &Gcode{word: 'X', addr: "6"}, 0.0001, nil},             // 0.0001 < 0.001
+			{"X1.235", &Gcode{word: 'X', addr: ""}, 1.23456789, nil},          // .3f
 		}
 
 		for _, c := range cases {
@@ -740,7 +816,7 @@ func TestGcode(t *testing.T) {
 		var origin *Gcode
 
 		var str string
-		origin = &Gcode{'X', "6"}
+		origin = &Gcode{word: 'X', addr: "6"}
 		origin.AddrAs(&str)
 		if str != "6" {
 			t.Errorf("unexpected addr: %v", str)
@@ -764,18 +840,76 @@ func TestGcode(t *testing.T) {
 			t.Errorf("unexpected addr: %v", f32)
 		}
 
-		origin = &Gcode{'X', ".000001"}
+		origin = &Gcode{word: 'X', addr: ".000001"}
 		origin.AddrAs(&f32)
 		if f32 != 0.000001 {
 			t.Errorf("unexpected addr: %v", f32)
 		}
 
 		var f64 float64
-		if err := origin.AddrAs(&f64); err == nil || err.Error() != "unsupported addr type as *float64" {
+		if err := origin.AddrAs(&f64); err != nil || f64 != 0.000001 {
+			t.Errorf("unexpected addr: %v, err: %v", f64, err)
+		}
+
+		var b bool
+		if err := origin.AddrAs(&b); err == nil || err.Error() != "unsupported addr type as *bool" {
 			t.Errorf("unexpected error: %v", err)
 		}
 	}
 
+	{ // typed addrs are parsed once, and written as they are read
+		g, _ := ParseGcode("X1.2300")
+		if v, ok := g.Float(); v != 1.23 || !ok {
+			t.Errorf("unexpected float: %v %v", v, ok)
+		}
+		if _, ok := g.Int(); ok {
+			t.Errorf("%s is not an integer", g)
+		}
+		if g.String() != "X1.2300" {
+			t.Errorf("unexpected string: %s", g)
+		}
+
+		g, _ = ParseGcode("T-12")
+		if v, ok := g.Int(); v != -12 || !ok {
+			t.Errorf("unexpected int: %v %v", v, ok)
+		}
+		var i int
+		if g, _ := ParseGcode("S1.5"); g.AddrAs(&i) != ErrValueSyntax {
+			t.Errorf("want ErrValueSyntax of %s", g)
+		}
+		if _, ok := (&Gcode{word: 'S', addr: "abc"}).Float(); ok {
+			t.Errorf("S abc is not a number")
+		}
+
+		// the value follows SetAddr
+		g.SetAddr(7)
+		if v, ok := g.Float(); v != 7 || !ok {
+			t.Errorf("unexpected float: %v %v", v, ok)
+		}
+		g.SetAddr("2.5")
+		if v, ok := g.Float(); v != 2.5 || !ok {
+			t.Errorf("unexpected float: %v %v", v, ok)
+		}
+		c := g.Copy()
+		c.SetAddr(1.0)
+		if g.String() != "T2.5" || c.String() != "T1.000" {
+			t.Errorf("unexpected copy: %s %s", g, c)
+		}
+
+		// precision by word
+		for word, want := range map[byte]string{'E': "-0.12346", 'X': "-0.123", 'S': "-0.123", 'F': "-0.123"} {
+			g := &Gcode{word: word}
+			g.SetAddr(-0.123456)
+			if g.Addr() != want {
+				t.Errorf("%c: got %s, want %s", word, g.Addr(), want)
+			}
+		}
+		g = &Gcode{word: 'E'}
+		if g.SetAddr(-0.000001); g.String() != "E0.00000" {
+			t.Errorf("unexpected -0: %s", g)
+		}
+	}
+
 }
 
 func TestParseGcodeBlock(t *testing.T) {
@@ -879,6 +1013,32 @@ func TestParseGcodeBlock(t *testing.T) {
 			{"G28 N*", "G28 N*"},
 			{"N**", "N**"},
 			{"N;comm", "N  ;comm"}, // N as command, %p be replaced as a space
+			{"N123", "N123"},
+			{"g1 x1.5 y-2 ; lowercase", "G1 X1.5 Y-2 ; lowercase"},
+			{"G1\tX1\tY2", "G1 X1 Y2"},
+			{"M117 Hello 3D world #1", "M117 Hello 3D world #1"},
+			{"M117 Hello; world", "M117 Hello; world"},
+			{"M117 Hello (x) world", "M117 Hello (x) world"},
+			{"M23 file (1).gcode", "M23 file (1).gcode"},
+			{"M118 A1 done ; 100%", "M118 A1 done ; 100%"},
+			{"M117", "M117"},
+			{"M1170 X1 ; not M117", "M1170 X1 ; not M117"},
+			{"M117  Printing   layer 2 ", "M117 Printing   layer 2"},
+			{"m118 E1 T0 done", "M118 E1 T0 done"},
+			{"M23 /gcodes/Part 1.gco", "M23 /gcodes/Part 1.gco"},
+			{"M32 P !/file.g#", "M32 P !/file.g#"},
+			{`M98 P"0:/macros/my file.g" ; quoted`, `M98 P"0:/macros/my file.g" ; quoted`},
+			{`M117 "a; b (c)"`, `M117 "a; b (c)"`},
+			{"G1 X10 (move) Y20", "G1 X10 Y20 ;(move)"},
+			{"G1 X10 (move) Y20 (fast) ; to Y20", "G1 X10 Y20 ;(move) (fast) ; to Y20"},
+			{"(comment only)", ";(comment only)"},
+			{"G1 X1 (unclosed", "G1 X1 ;(unclosed"},
+			{"N3 T0*57", "N3 T0*57"},
+			{"N10 G1 X1 Y2 *45 ; move", "N10 G1 X1 Y2*45 ; move"},
+			{"n7 m117 Hi*19", "N7 M117 Hi*19"},
+			{"N5 M117 2*3 = 6", "N5 M117 2*3 = 6"},
+			{"N5 G28", "N5 G28"},
+			{"G1 X1*45", "G1 X1*45"}, // no checksum without N
 		}
 
 		for _, c := range cases {
@@ -894,6 +1054,69 @@ func TestParseGcodeBlock(t *testing.T) {
 	}
 }
 
+func TestGcodeLineNumber(t *testing.T) {
+	g, err := ParseGcodeBlock("N10 M117 Hello world *7 ; message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := g.LineNumber(); n != 10 || !ok || g.Checksum() != "7" || g.Text() != "Hello world" || len(g.Params()) != 0 {
+		t.Errorf("N%d %v *%s %q %v", n, ok, g.Checksum(), g.Text(), g.Params())
+	}
+	// the checksum of RepRap wiki
+	g, _ = ParseGcodeBlock("N3 T0")
+	g.SetLineNumber(3)
+	if g.String() != "N3 T0*57" {
+		t.Errorf("got %s, want N3 T0*57", g)
+	}
+	// the checksum follows the changes of the line
+	g, _ = ParseGcodeBlock("N10 G1 X1*80")
+	if g.String() != "N10 G1 X1*80" {
+		t.Errorf("got %s, want N10 G1 X1*80", g)
+	}
+	for _, change := range []func(){
+		func() { g.SetParam('X', "2.5") },
+		func() { g.Params()[0].SetAddr(3) },
+		func() { g.Cmd().SetAddr(0) },
+	} {
+		change()
+		line := g.Copy()
+		line.SetLineNumber(10)
+		if g.String() != line.String() || g.Checksum() != line.Checksum() {
+			t.Errorf("%s: want checksum %s", g, line.Checksum())
+		}
+	}
+	if g, _ := ParseGcodeBlock("G1 X1"); func() bool { _, ok := g.LineNumber(); return ok }() {
+		t.Errorf("%s has no N", g)
+	}
+
+	// renumber the lines which are inserted or removed
+	gcodes := _parseGcodes(`
+N1 G28*18
+N2 G1 X1*97
+G1 X2 ;(Fixed: inserted)
+N4 G1 X3*97
+N5 M110 N100*89
+N101 M117 Done*57
+`)
+	result, err := renumberLines(NewContext(NewParams(), nil), gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "N1 G28*18,N2 G1 X1*99,G1 X2 ;(Fixed: inserted),N3 G1 X3*96,N4 M110 N100*120,N101 M117 Done*36"
+	for _, g := range result {
+		if n, ok := g.LineNumber(); ok {
+			line := g.Copy()
+			line.SetLineNumber(n)
+			if line.String() != g.String() {
+				t.Errorf("%s: want checksum %s", g, line.Checksum())
+			}
+		}
+	}
+	if got := _joinGcodes(result); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
 func TestGcodeFixOrcaToolUnload(t *testing.T) {
 	gcode := `
 M104 S199
@@ -950,7 +1173,7 @@ M104 S299
 	comp_gcodes := _parseGcodes(comp)
 
 	result := GcodeFixOrcaToolUnload(gcodes)
-	if (reflect.DeepEqual(result, comp_gcodes)) != true {
+	if !_equalGcodes(result, comp_gcodes) {
 		results := make([]string, 0, len(result)+len(comp_gcodes)+1)
 		for _, g := range result {
 			results = append(results, g.String())
@@ -983,6 +1206,7 @@ func BenchmarkGcodeAsType(b *testing.B) {
 		b.Fatal(err)
 	}
 	var t float32
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		err = g.AddrAs(&t)
 		if err != nil {
@@ -992,6 +1216,27 @@ func BenchmarkGcodeAsType(b *testing.B) {
 	}
 }
 
+func BenchmarkMachineState(b *testing.B) {
+	gcodes := _parseGcodes(`
+G90
+M83
+G1 X10.5 Y20.25 Z0.3 F3000
+G1 X12.123 Y22.456 E0.04512
+G1 X14.8 Y21.9 E.0321 F1800
+G92 E0
+M104 S210 T1
+M106 P0 S127.5
+`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewMachineState()
+		for _, g := range gcodes {
+			s.Update(g)
+		}
+	}
+}
+
 func BenchmarkToolNum(b *testing.B) {
 	g, err := ParseGcodeBlock("M104 S255 T1 ; tool T2")
 	if err != nil {
@@ -1007,3 +1252,1957 @@ func BenchmarkToolNum(b *testing.B) {
 		}
 	}
 }
+
+func TestPipeline(t *testing.T) {
+	gcodes := _parseGcodes(`
+T0
+M104 S200 T1
+T1
+T0
+M104 S0 T0
+`)
+	opts := Options{}
+	if err := opts.Parse("preheat.long = 5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.Parse("=5"); err == nil {
+		t.Error("expected error for empty key")
+	}
+	if v := opts.Int("preheat.long", 3); v != 5 {
+		t.Errorf("got %d, want 5", v)
+	}
+	if v := opts.Float("missing", 0.5); v != 0.5 {
+		t.Errorf("got %g, want 0.5", v)
+	}
+
+	ctx := NewContext(nil, opts)
+	p, err := NewPipeline("shutoff", "orcatoolunload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Adapt("old", func(gcodes []*GcodeBlock) []*GcodeBlock {
+		return gcodes[1:]
+	})
+	failed := NewModifier("failed", func(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+		ctx.Record(0, "nothing")
+		return nil, ErrInvalidGcode
+	})
+
+	result, err := append(p, old).Run(ctx, gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(gcodes) { // +1 shutoff, -1 old
+		t.Errorf("got %d lines, want %d", len(result), len(gcodes))
+	}
+	if n := ctx.Changes.Count("shutoff"); n != 1 {
+		t.Errorf("got %d changes, want 1: %v", n, ctx.Changes.Changes())
+	}
+	if s := ctx.Changes.Summary(); len(s) != 1 || s[0] != "shutoff: 1 changes" {
+		t.Errorf("unexpected summary: %v", s)
+	}
+
+	if _, err := (Pipeline{failed}).Run(ctx, result); !errors.Is(err, ErrInvalidGcode) || !strings.HasPrefix(err.Error(), "failed: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewPipeline("missing"); err == nil {
+		t.Error("expected error for unknown modifier")
+	}
+	if err := RegisterModifier(NewModifier("shutoff", nil)); err == nil {
+		t.Error("expected error for duplicate modifier")
+	}
+}
+
+// TestPluginHelperProcess is not a real test, it is the plugin executed by TestPlugin
+func TestPluginHelperProcess(t *testing.T) {
+	mode := os.Getenv("SMFIX_TEST_PLUGIN")
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	var params PluginParams
+	if err := json.Unmarshal([]byte(os.Getenv("SMFIX_PARAMS")), &params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	sc := bufio.NewScanner(os.Stdin)
+	switch mode {
+	case "snapshot":
+		fmt.Fprintf(os.Stderr, "model %s\n", params.Model)
+		for sc.Scan() {
+			fmt.Println(sc.Text())
+			if sc.Text() == ";LAYER_CHANGE" {
+				fmt.Println("M240 ; snapshot")
+			}
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for sc.Scan() {
+			var g GcodeBlock
+			if err := json.Unmarshal(sc.Bytes(), &g); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			if g.Is("M106") {
+				g.SetParam('S', "200")
+			}
+			enc.Encode(&g)
+		}
+	case "sleep":
+		time.Sleep(10 * time.Second)
+	case "orphan":
+		// a child which keeps stdout open after the plugin exits
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPluginHelperProcess$")
+		cmd.Env = append(os.Environ(), "SMFIX_TEST_PLUGIN=sleep")
+		cmd.Stdout = os.Stdout
+		cmd.Start()
+		for sc.Scan() {
+			fmt.Println(sc.Text())
+		}
+	case "garbage":
+		fmt.Println(`{"cmd":"G1","params":["x1"]}`)
+	case "fail":
+		os.Exit(3)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	run := func(mode, format string, timeout time.Duration) ([]*GcodeBlock, *Context, error) {
+		t.Setenv("SMFIX_TEST_PLUGIN", mode)
+		p, err := NewPlugin("test", os.Args[0]+" -test.run=^TestPluginHelperProcess$")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Format = format
+		p.Timeout = timeout
+
+		params := NewParams()
+		params.Model = ModelJ1
+		ctx := NewContext(params, nil)
+		out := &bytes.Buffer{}
+		ctx.Logger.SetOutput(out)
+		gcodes := _parseGcodes(`
+;LAYER_CHANGE
+G1 X1 Y2 E.3 ; move
+M106 P1 S255
+;LAYER_CHANGE
+`)
+		result, err := Pipeline{p}.Run(ctx, gcodes)
+		if err == nil && !strings.Contains(out.String(), "[test] model "+ModelJ1) && mode == "snapshot" {
+			t.Errorf("unexpected log: %q", out.String())
+		}
+		return result, ctx, err
+	}
+
+	result, ctx, err := run("snapshot", PluginFormatText, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ";LAYER_CHANGE,M240  ; snapshot,G1 X1 Y2 E.3 ; move,M106 P1 S255,;LAYER_CHANGE,M240  ; snapshot"
+	if got := _joinGcodes(result); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := ctx.Changes.Count("test"); n != 1 {
+		t.Errorf("got %d changes, want 1", n)
+	}
+
+	result, _, err = run("json", PluginFormatJSON, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ";LAYER_CHANGE,G1 X1 Y2 E.3 ; move,M106 P1 S200,;LAYER_CHANGE"
+	if got := _joinGcodes(result); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, _, err = run("sleep", PluginFormatText, 200*time.Millisecond); !errors.Is(err, ErrPluginTimeout) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	start := time.Now()
+	if _, _, err = run("orphan", PluginFormatText, time.Minute); !errors.Is(err, exec.ErrWaitDelay) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("waited %s for the output of the orphan", d)
+	}
+	if _, _, err = run("garbage", PluginFormatJSON, time.Minute); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err = run("fail", PluginFormatText, time.Minute); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewPlugin("empty", " "); err == nil {
+		t.Error("expected error for empty command")
+	}
+
+	// placed in the pipeline by name
+	p, _ := NewPlugin("plugintest", "true")
+	if err := RegisterModifier(p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		modifiersMu.Lock()
+		delete(modifiers, p.Name())
+		modifiersMu.Unlock()
+	})
+	if pipeline, err := NewPipeline("shutoff", "plugintest", "optimize"); err != nil || pipeline[1] != Modifier(p) {
+		t.Errorf("unexpected pipeline: %v, err: %v", pipeline, err)
+	}
+}
+
+func _joinGcodes(gcodes []*GcodeBlock) string {
+	lines := make([]string, 0, len(gcodes))
+	for _, g := range gcodes {
+		lines = append(lines, g.String())
+	}
+	return strings.Join(lines, ",")
+}
+
+func TestRules(t *testing.T) {
+	config := `
+# fans
+rule = M106 P1 S* -> S = min(S, 200)
+rule = M106 !P -> P = 0; comment "fan of T0"
+rule = @layer if layer == 3 -> insert after "M600"
+rule = G1 Z* if z >= 0.6 && F > 1000 -> F = 1000
+rule = M104 if S == nozzle_temp(0) && filament_type(0) == "PLA" -> S = S + 5
+rule = G4 -> remove
+rule = M117 -> insert before "M118 E1 hello" ; unset P
+`
+	opts := Options{}
+	if err := opts.Load(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	params := NewParams()
+	params.NozzleTemperatures = []float64{210, 220}
+	params.FilamentTypes = []string{"PLA", "PETG"}
+	ctx := NewContext(params, opts)
+
+	gcodes := _parseGcodes(`
+M106 P1 S255
+M106 P1 S100
+M106 P0 S255
+M106 S128
+M104 S210
+M104 S220
+;LAYER_CHANGE
+;Z:0.2
+G1 Z.2 F3000
+;LAYER_CHANGE
+;Z:0.4
+G1 Z.4 F3000
+;LAYER_CHANGE
+;Z:0.6
+G1 Z.6 F3000
+G4 P100
+M117 P2
+`)
+	// the argument of M117 is a string, unset P does not change it
+	want := _parseGcodes(`
+M106 P1 S200
+M106 P1 S100
+M106 P0 S255
+M106 S128 P0 ; fan of T0
+M104 S215
+M104 S220
+;LAYER_CHANGE
+;Z:0.2
+G1 Z.2 F3000
+;LAYER_CHANGE
+;Z:0.4
+G1 Z.4 F3000
+;LAYER_CHANGE
+M600 ;(Fixed: rule 3)
+;Z:0.6
+G1 Z.6 F1000
+;(Fixed: remove by rule: G4 P100)
+M118 E1 hello ;(Fixed: rule 7)
+M117 P2
+`)
+	result, err := Pipeline{NewModifier("rules", applyRules)}.Run(ctx, gcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := _joinGcodes(result), _joinGcodes(want); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if n := ctx.Changes.Count("rules"); n != 8 {
+		t.Errorf("got %d changes, want 8", n)
+	}
+
+	for _, rule := range []string{
+		"M106 S*",
+		"-> S = 1",
+		"M106 -> S = ",
+		"M106 -> S = foo",
+		"M106 -> S = min(1)",
+		"M106 -> S = (1 + 2",
+		"M106 if S > -> remove",
+		"M106 -> insert \"106\"",
+		"M106 -> launch",
+		"M106 -> comment \"unterminated",
+		"M106 1 -> remove",
+	} {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("expected error for rule %q", rule)
+		}
+	}
+
+	ctx = NewContext(params, Options{"rule": {"M104 -> S = S / 0"}})
+	if _, err := applyRules(ctx, _parseGcodes("M104 S200")); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	ctx = NewContext(params, Options{"rule": {"M104 if S / 0 > 1 -> remove"}})
+	if _, err := applyRules(ctx, _parseGcodes("M104 S200")); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	ctx = NewContext(params, Options{"rule": {"M104 if T > 0 -> remove"}})
+	if result, err := applyRules(ctx, _parseGcodes("M104 S200")); err != nil || _joinGcodes(result) != "M104 S200" {
+		t.Errorf("unexpected result: %s, err: %v", _joinGcodes(result), err)
+	}
+
+	// the removed line is not changed by the actions after remove, or by the rules after it
+	ctx = NewContext(params, Options{"rule": {"G4 -> remove; P = 1", "G4 -> P = 2"}})
+	if result, err := applyRules(ctx, _parseGcodes("G4 P100")); err != nil || _joinGcodes(result) != ";(Fixed: remove by rule: G4 P100)" {
+		t.Errorf("unexpected result: %s, err: %v", _joinGcodes(result), err)
+	}
+}
+
+func TestMachineState(t *testing.T) {
+	gcodes := _parseGcodes(`
+G28
+M140 S60
+M104 S200 T1
+T0
+M109 S210
+G90
+M82
+G1 X10 Y20 Z.2 E1 F1200
+G92 E0
+;LAYER_CHANGE
+;Z:0.4
+G91
+G1 X5 Y-5 E2
+G90
+M83
+G1 Z.4 E.5 F600
+M106 S128
+M106 P1
+M107
+T1
+G92
+`)
+	cases := []struct {
+		n    int
+		want func(s MachineState) bool
+	}{
+		{-1, func(s MachineState) bool { return s.Tool == -1 && s.X == 0 }},
+		{1, func(s MachineState) bool { return s.BedTemp == 60 }},
+		{2, func(s MachineState) bool { return s.Temps[1] == 200 && s.Temps[0] == 0 && s.Tool == -1 }},
+		{4, func(s MachineState) bool { return s.Tool == 0 && s.Temps[0] == 210 }},
+		{7, func(s MachineState) bool { return s.X == 10 && s.Y == 20 && s.Z == .2 && s.E == 1 && s.F == 1200 }},
+		{8, func(s MachineState) bool { return s.E == 0 && s.X == 10 }},
+		{10, func(s MachineState) bool { return s.Layer == 1 && s.LayerZ == .4 }},
+		{12, func(s MachineState) bool { return s.X == 15 && s.Y == 15 && s.E == 2 && s.Relative && s.RelativeE }},
+		{15, func(s MachineState) bool { return s.Z == .4 && s.E == 2.5 && s.F == 600 && !s.Relative && s.RelativeE }},
+		{17, func(s MachineState) bool { return s.Fans[0] == 128 && s.Fans[1] == 255 }},
+		{18, func(s MachineState) bool { return s.Fans[0] == 0 && s.Fans[1] == 255 }},
+		{20, func(s MachineState) bool { return s.Tool == 1 && s.X == 0 && s.E == 0 && s.Layer == 1 }},
+	}
+
+	tracker := TrackState(gcodes)
+	for _, c := range cases {
+		if s := tracker.At(c.n); !c.want(s) {
+			t.Errorf("line %d: unexpected state %+v", c.n, s)
+		}
+	}
+	// query backwards
+	for i := len(cases) - 1; i >= 0; i-- {
+		if s := tracker.At(cases[i].n); !cases[i].want(s) {
+			t.Errorf("line %d: unexpected state %+v", cases[i].n, s)
+		}
+	}
+
+	// across checkpoints
+	many := make([]*GcodeBlock, 0, 3*stateCheckpointEvery)
+	for i := 0; i < 3*stateCheckpointEvery; i++ {
+		g, _ := ParseGcodeBlock(fmt.Sprintf("G1 X%d", i))
+		many = append(many, g)
+	}
+	tracker = TrackState(many)
+	for _, n := range []int{1500, 3, 1024, 1023, 513, 512, 511, 1535, 9999} {
+		want := float64(n)
+		if n >= len(many) {
+			want = float64(len(many) - 1)
+		}
+		if s := tracker.At(n); s.X != want {
+			t.Errorf("line %d: got X%g, want X%g", n, s.X, want)
+		}
+	}
+}
+
+func TestDetectLayers(t *testing.T) {
+	type want struct {
+		z     float64
+		start int
+		end   int
+		tools string
+	}
+	check := func(t *testing.T, gcode string, wants []want) {
+		li := DetectLayers(_parseGcodes(gcode))
+		if li.Len() != len(wants) {
+			t.Fatalf("got %d layers, want %d: %+v", li.Len(), len(wants), li.Layers())
+		}
+		for i, l := range li.Layers() {
+			w := wants[i]
+			if l.Index != i || l.Z != w.z || l.StartLine != w.start || l.EndLine != w.end || fmt.Sprint(l.Tools) != w.tools {
+				t.Errorf("layer %d: got %+v, want %+v", i, l, w)
+			}
+			if at := li.At(l.StartLine); at != i {
+				t.Errorf("line %d: got layer %d, want %d", l.StartLine, at, i)
+			}
+		}
+		if at := li.At(0); at != -1 {
+			t.Errorf("line 0: got layer %d, want -1", at)
+		}
+	}
+
+	t.Run("prusaslicer", func(t *testing.T) {
+		check(t, `G28
+;LAYER_CHANGE
+;Z:0.2
+;HEIGHT:0.2
+G1 Z.2
+G1 X1 E1
+;LAYER_CHANGE
+;Z:0.4
+;HEIGHT:0.2
+T1
+G1 Z.4
+G1 X2 E2
+;Z:0.4
+T0
+G1 X3 E3`, []want{
+			{0.2, 1, 5, "[0]"},
+			{0.4, 6, 14, "[1 0]"},
+		})
+	})
+
+	t.Run("bambustudio", func(t *testing.T) {
+		check(t, `G28
+; CHANGE_LAYER
+; Z_HEIGHT: 0.2
+; LAYER_HEIGHT: 0.2
+G1 X1 E1
+; CHANGE_LAYER
+; Z_HEIGHT: 0.4
+; LAYER_HEIGHT: 0.2
+G1 X2 E2`, []want{
+			{0.2, 1, 4, "[0]"},
+			{0.4, 5, 8, "[0]"},
+		})
+	})
+
+	t.Run("orcaslicer", func(t *testing.T) {
+		// both kinds of marker, only the first one counts
+		check(t, `G28
+;LAYER_CHANGE
+;Z:0.3
+; CHANGE_LAYER
+; Z_HEIGHT: 0.3
+G1 X1 E1
+;LAYER_CHANGE
+;Z:0.5
+; CHANGE_LAYER
+; Z_HEIGHT: 0.5
+G1 X2 E2`, []want{
+			{0.3, 1, 5, "[0]"},
+			{0.5, 6, 10, "[0]"},
+		})
+	})
+
+	t.Run("cura", func(t *testing.T) {
+		check(t, `G28
+;LAYER:0
+G0 Z.3
+G1 X1 E1
+;LAYER:1
+G0 Z.5
+G1 X2 E2`, []want{
+			{0.3, 1, 3, "[0]"},
+			{0.5, 4, 6, "[0]"},
+		})
+	})
+
+	t.Run("z comments", func(t *testing.T) {
+		check(t, `G28
+;Z:0.3
+G1 X1 E1
+;Z:0.4
+G1 X2 E2`, []want{
+			{0.3, 1, 2, "[0]"},
+			{0.4, 3, 4, "[0]"},
+		})
+	})
+
+	t.Run("moves", func(t *testing.T) {
+		check(t, `G28
+G92 E0
+G1 Z.2 F600
+G1 X1 E1
+G1 Z.6 ; z hop
+G1 X10
+G1 Z.2
+G1 X2 E2
+G1 Z.4
+T1
+G1 X3 E3
+G91
+G1 Z.2
+G1 X1 E1`, []want{
+			{0.2, 2, 7, "[0]"},
+			{0.4, 8, 11, "[1]"},
+			{0.6, 12, 13, "[1]"},
+		})
+	})
+
+	t.Run("height", func(t *testing.T) {
+		gcodes := _parseGcodes(`G28
+;LAYER_CHANGE
+;Z:0.2
+G1 X1 E1
+;LAYER_CHANGE
+;Z:0.4
+G1 X1 E2`)
+		li := DetectLayers(gcodes)
+		if h := li.Layers()[1].Height; h != 0.2 {
+			t.Errorf("got height %g, want 0.2", h)
+		}
+	})
+}
+
+func TestMotionModel(t *testing.T) {
+	m := MotionModel{Accel: 1000, MaxSpeed: 100, HeatRate: 2, BedRate: 0.5}
+	gcodes := _parseGcodes(`
+G1 X10 F600
+G1 X10.5 F6000
+G1 X310.5 F60000
+G4 P500
+G4 S2
+M104 S200 T1
+M109 S210 T1
+M190 S60
+G1 E5 F300
+`)
+	want := []float64{
+		10/10.0 + 10/1000.0,     // trapezoid
+		2 * math.Sqrt(0.5/1000), // never reaches the speed
+		300/100.0 + 100/1000.0,  // max speed
+		0.5, 2,                  // dwell
+		0, 5, // heat from 200 to 210
+		120,              // bed
+		5/5.0 + 5/1000.0, // extrude only
+	}
+	times := m.Estimate(gcodes)
+	elapsed := 0.0
+	for i, w := range want {
+		elapsed += w
+		if math.Abs(times[i]-elapsed) > 1e-9 {
+			t.Errorf("line %d: got %g, want %g", i, times[i], elapsed)
+		}
+	}
+
+	ctx := NewContext(nil, Options{"preheat.rate": {"4"}})
+	ctx.Params.Model = ModelJ1
+	if m := NewMotionModel(ctx); m.HeatRate != 4 || m.Accel != 3000 {
+		t.Errorf("unexpected model: %+v", m)
+	}
+}
+
+func TestGcodePreheatTime(t *testing.T) {
+	gcode := `
+M104 S210 T0
+M104 S210 T1
+;LAYER_CHANGE
+;Z:0.2
+T1
+G1 X10 E1 F600
+M104 T1 S150 ; standby
+T0
+G1 X70 E1 F600
+G1 X130 E1 F600
+G1 X190 E1 F600
+T1
+M109 T1 S210
+G1 X200 E1
+M104 S150 ; standby T1
+T0
+G1 X210 E1
+T1
+M109 S210 ; wait T1
+G1 X220 E1
+`
+	want := `
+M104 S210 T0
+M104 S210 T1
+;LAYER_CHANGE
+;Z:0.2
+T1
+G1 X10 E1 F600
+M104 T1 S150 ; standby
+T0
+G1 X70 E1 F600
+G1 X130 E1 F600
+M104 T1 S210 ;(Fixed: pre-heat 6s)
+G1 X190 E1 F600
+T1
+M109 T1 S210
+G1 X200 E1
+;(Fixed: remove cooldown: M104 S150)
+T0
+G1 X210 E1
+T1
+;(Fixed: already stabilized temp: M109 S210)
+G1 X220 E1
+`
+	ctx := NewContext(nil, Options{"preheat.rate": {"10"}, "time.accel": {"0"}})
+	result, err := Pipeline{NewModifier("preheat", fixPreheat)}.Run(ctx, _parseGcodes(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(want)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	ctx = NewContext(nil, Options{"preheat.mode": {"m74"}})
+	if _, err := fixPreheat(ctx, _parseGcodes(gcode)); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestGcodeStandby(t *testing.T) {
+	gcode := `
+M104 S210 T0
+M104 S230 T1
+;LAYER_CHANGE
+;Z:0.2
+T1
+G1 X10 E1 F600
+T0
+G1 X70 E1 F600
+G1 X130 E1 F600
+G1 X190 E1 F600
+T1
+G1 X200 E1
+T0
+G1 X205 E1
+T1
+M109 S230
+G1 X210 E1
+T0
+`
+	want := `
+M104 S210 T0
+M104 S230 T1
+;LAYER_CHANGE
+;Z:0.2
+T1
+G1 X10 E1 F600
+T0
+M104 T1 S170 ;(Fixed: standby T1)
+G1 X70 E1 F600
+G1 X130 E1 F600
+G1 X190 E1 F600
+T1
+M109 T1 S230 ;(Fixed: wait T1)
+G1 X200 E1
+T0
+G1 X205 E1
+T1
+M109 S230
+G1 X210 E1
+T0
+`
+	params := NewParams()
+	params.FilamentTypes = []string{"PLA", "PETG-CF"}
+	ctx := NewContext(params, Options{"standby.after": {"10"}, "time.accel": {"0"}})
+	result, err := Pipeline{NewModifier("standby", fixStandby)}.Run(ctx, _parseGcodes(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(want)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	// hand off to preheat
+	ctx.Options.Add("preheat.rate", "10")
+	result, err = Pipeline{NewModifier("preheat", fixPreheat)}.Run(ctx, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := _joinGcodes(result); !strings.Contains(got, "G1 X130 E1 F600,M104 T1 S230 ;(Fixed: pre-heat 6s),G1 X190 E1 F600") {
+		t.Errorf("pre-heat not found: %s", got)
+	}
+
+	// a retract in absolute E is not an extrusion before M109
+	for _, c := range []struct {
+		gcode string
+		want  bool
+	}{
+		{"M82,G1 X1 E5,T1,G1 E4.2 F2400,M109 S230 T1,G1 E5,G1 X2 E6", true},
+		{"M82,G1 X1 E5,T1,G1 X2 E5.5,M109 S230 T1", false},
+		{"M83,G1 X1 E5,T1,G1 E-0.8,G92 E0,M109 S230 T1", true},
+	} {
+		gcodes := _parseGcodes(strings.ReplaceAll(c.gcode, ",", "\n"))
+		if got := waitsForTemp(gcodes, 2, 1, TrackState(gcodes).At(2)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.gcode, got, c.want)
+		}
+	}
+
+	cases := []struct {
+		opts Options
+		typ  string
+		want float64
+	}{
+		{Options{}, "PLA", 150},
+		{Options{}, "pla+", 150},
+		{Options{}, "PETG", 170},
+		{Options{}, "unknown", 150},
+		{Options{"standby.ratio": {"0.5"}}, "PLA", 100},
+		{Options{"standby.temp": {"120"}, "standby.ratio": {"0.5"}}, "PLA", 120},
+	}
+	for _, c := range cases {
+		params.FilamentTypes = []string{c.typ, ""}
+		if got := standbyTemp(NewContext(params, c.opts), 0, 200); got != c.want {
+			t.Errorf("%s %v: got %g, want %g", c.typ, c.opts, got, c.want)
+		}
+	}
+}
+
+func TestMaterials(t *testing.T) {
+	table := MaterialTable{}
+	for k, v := range Materials {
+		table[k] = v
+	}
+
+	lookups := []struct {
+		typ     string
+		density float64
+		ok      bool
+	}{
+		{"PLA", 1.24, true},
+		{"petg-cf", 1.30, true},
+		{"PETG-HF", 1.27, true},
+		{"PA12-CF", 1.14, true},
+		{"PLA+", 1.24, true},
+		{"PCTG", 0, false},
+		{"PETG", 1.27, true},
+		{"WOOD", 0, false},
+	}
+	for _, c := range lookups {
+		m, ok := table.Lookup(c.typ)
+		if ok != c.ok || m.Density != c.density {
+			t.Errorf("%s: got %v %v", c.typ, m, ok)
+		}
+	}
+	if m := table.LookupOrDefault("WOOD"); m != DefaultMaterial {
+		t.Errorf("default: got %v", m)
+	}
+
+	if err := table.Override(Options{
+		"material.petg.standby_temp": {"160", "175"},
+		"material.WOOD.density":      {"1.15"},
+		"preheat.rate":               {"2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if m := table["PETG"]; m.StandbyTemp != 175 || m.Density != 1.27 {
+		t.Errorf("PETG: got %v", m)
+	}
+	if m := table["WOOD"]; m.Density != 1.15 || m.StandbyTemp != DefaultMaterial.StandbyTemp {
+		t.Errorf("WOOD: got %v", m)
+	}
+	for _, opts := range []Options{
+		{"material.PLA.color": {"1"}},
+		{"material.PLA.density": {"heavy"}},
+		{"material..density": {"1"}},
+		{"material.density": {"1.2"}},
+		{"material.PLA.density.max": {"1"}},
+		{"material.PLA.": {"1"}},
+	} {
+		if err := table.Override(opts); err == nil {
+			t.Errorf("%v: expected an error", opts)
+		}
+	}
+
+	if w := FilamentWeight(1000, 1.75, 1.24); math.Abs(w-2.9825) > 1e-3 {
+		t.Errorf("weight: got %g", w)
+	}
+
+	params := NewParams()
+	params.FilamentTypes = []string{"PETG", "unknown"}
+	ctx := NewContext(params, nil)
+	if v := deepFreezeTemp(ctx, 0); v != 150 {
+		t.Errorf("deep freeze PETG: got %g", v)
+	}
+	if v := deepFreezeTemp(ctx, 1); v != 110 {
+		t.Errorf("deep freeze unknown: got %g", v)
+	}
+
+	var buf strings.Builder
+	ctx.Logger = log.New(&buf, "", 0)
+	checkColdExtrusion(ctx, _parseGcodes(`
+T0
+M104 S230
+G1 X1 E1
+M104 S170
+G1 X2 E2
+G1 X3 E3
+T1
+M104 S100
+G1 X1 E4
+`))
+	if got := buf.String(); got != "warning: line 5: T0 extrudes PETG at 170°C, below 220°C\n" {
+		t.Errorf("cold extrusion: got %q", got)
+	}
+}
+
+func TestReinforceTowerModes(t *testing.T) {
+	orca := `
+M83
+;LAYER_CHANGE
+;Z:0.2
+; WIPE_TOWER_START
+G1 X10 Y10 E1 F1200
+; WIPE_TOWER_END
+;LAYER_CHANGE
+;Z:0.4
+G1 X0 Y0 F6000
+; WIPE_TOWER_START
+G1 X10 Y0 E1 F1200
+G1 X10 Y2 E0.2
+G1 X0 Y2 E1
+G1 E-0.8
+; WIPE_TOWER_END
+`
+	absolute := `
+M82
+;LAYER_CHANGE
+;Z:0.4
+G1 X0 Y0 E5 F6000
+; CP TOOLCHANGE WIPE
+G1 X10 Y0 E6 F1200
+G1 X10 Y2 E6.2
+G1 X0 Y2 E7.2 F1200
+; CP TOOLCHANGE END
+G1 X5 Y5 E8
+`
+	cases := []struct {
+		name  string
+		gcode string
+		opts  Options
+		want  string
+	}{
+		{"orca extra", orca, Options{}, `
+M83,;LAYER_CHANGE,;Z:0.2,; WIPE_TOWER_START,G1 X10 Y10 E1 F1200,; WIPE_TOWER_END,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 F6000,; WIPE_TOWER_START,
+G1 E0.45 F1200 ;(Fixed: reinforce tower),G1 X10 Y0 E1 F1200,G1 X10 Y2 E0.2,G1 X0 Y2 E1,G1 E-0.8,; WIPE_TOWER_END`},
+		{"orca zmax", orca, Options{"reinforce.zmax": {"0.3"}}, `
+M83,;LAYER_CHANGE,;Z:0.2,; WIPE_TOWER_START,G1 X10 Y10 E1 F1200,; WIPE_TOWER_END,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 F6000,; WIPE_TOWER_START,
+G1 X10 Y0 E1 F1200,G1 X10 Y2 E0.2,G1 X0 Y2 E1,G1 E-0.8,; WIPE_TOWER_END`},
+		{"orca flow", orca, Options{"reinforce.mode": {"flow"}, "reinforce.ratio": {"0.5"}}, `
+M83,;LAYER_CHANGE,;Z:0.2,; WIPE_TOWER_START,G1 X10 Y10 E1 F1200,; WIPE_TOWER_END,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 F6000,; WIPE_TOWER_START,
+;(Fixed: reinforce tower, flow +50%),G1 X10 Y0 E1.50000 F1200,G1 X10 Y2 E0.30000,G1 X0 Y2 E1.50000,G1 E-0.8,; WIPE_TOWER_END`},
+		{"orca perimeter", orca, Options{"reinforce.mode": {"perimeter"}, "reinforce.width": {"0.5"}}, `
+M83,;LAYER_CHANGE,;Z:0.2,; WIPE_TOWER_START,G1 X10 Y10 E1 F1200,; WIPE_TOWER_END,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 F6000,; WIPE_TOWER_START,
+G1 X10 Y0 E1 F1200,G1 X10 Y2 E0.2,G1 X0 Y2 E1,
+G1 X-0.500 Y-0.500 F1200 ;(Fixed: reinforce tower, perimeter 1),
+G1 X10.500 Y-0.500 E1.10000,G1 X10.500 Y2.500 E0.30000,G1 X-0.500 Y2.500 E1.10000,G1 X-0.500 Y-0.500 E0.30000,
+G1 E-0.8,; WIPE_TOWER_END`},
+		{"absolute perimeter", strings.Replace(absolute, "; CP TOOLCHANGE END", "G1 E6.4\n; CP TOOLCHANGE END", 1),
+			Options{"reinforce.mode": {"perimeter"}, "reinforce.width": {"0.5"}}, `
+M82,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 E5 F6000,; CP TOOLCHANGE WIPE,G1 X10 Y0 E6 F1200,G1 X10 Y2 E6.2,G1 X0 Y2 E7.2 F1200,
+G1 X-0.500 Y-0.500 F1200 ;(Fixed: reinforce tower, perimeter 1),
+G1 X10.500 Y-0.500 E8.30000,G1 X10.500 Y2.500 E8.60000,G1 X-0.500 Y2.500 E9.70000,G1 X-0.500 Y-0.500 E10.00000,
+G1 E9.20000,G92 E6.40000 ;(Fixed: reinforce tower, restore E),; CP TOOLCHANGE END,G1 X5 Y5 E8`},
+		{"absolute extra", absolute, Options{}, `
+M82,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 E5 F6000,; CP TOOLCHANGE WIPE,
+G1 E5.45000 F1200 ;(Fixed: reinforce tower),G1 X10 Y0 E6.45000 F1200,G1 X10 Y2 E6.65000,
+G1 E7.10000 F1200 ;(Fixed: reinforce tower),G1 X0 Y2 E8.10000 F1200,
+G92 E7.20000 ;(Fixed: reinforce tower, restore E),; CP TOOLCHANGE END,G1 X5 Y5 E8`},
+		{"absolute flow", absolute, Options{"reinforce.mode": {"flow"}, "reinforce.ratio": {"0.5"}}, `
+M82,;LAYER_CHANGE,;Z:0.4,G1 X0 Y0 E5 F6000,; CP TOOLCHANGE WIPE,
+;(Fixed: reinforce tower, flow +50%),G1 X10 Y0 E6.50000 F1200,G1 X10 Y2 E6.80000,G1 X0 Y2 E8.30000 F1200,
+G92 E7.20000 ;(Fixed: reinforce tower, restore E),; CP TOOLCHANGE END,G1 X5 Y5 E8`},
+	}
+	for _, c := range cases {
+		result, err := reinforceTower(NewContext(NewParams(), c.opts), _parseGcodes(c.gcode))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(c.want), "\n", ""); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	for _, opts := range []Options{{"reinforce.mode": {"thicker"}}, {"reinforce.ratio": {"-1"}}} {
+		if _, err := reinforceTower(NewContext(NewParams(), opts), nil); err == nil {
+			t.Errorf("%v: expected an error", opts)
+		}
+	}
+}
+
+func TestRewriteToolChanges(t *testing.T) {
+	prusa := `
+M83
+T0
+;LAYER_CHANGE
+;Z:0.4
+G1 Z0.4 F720
+G1 X10 Y10 E1 F1200
+; CP TOOLCHANGE START
+; toolchange #1
+; material : PLA -> PETG
+;--------------------
+M220 B
+M220 S100
+; CP TOOLCHANGE UNLOAD
+G1 E-0.8 F2100
+G1 Z0.6 F720
+G1 X100 Y100 F9000
+G1 Z0.4 F720
+M104 S170 T0 ; standby T0
+T1
+M109 S240 T1 ; wait T1
+G1 E0.8 F2100
+M220 R
+G1 X110 Y100 F9000
+; CP TOOLCHANGE WIPE
+G1 X120 Y100 E0.5 F1800
+; CP TOOLCHANGE END
+`
+	orca := `
+M82
+M109 S240 T1
+T0
+;LAYER_CHANGE
+;Z:0.6
+G1 X5 Y5 E10 F1200
+; CP TOOLCHANGE START
+; toolchange #2
+; material : PLA -> PETG
+;--------------------
+M220 B
+M220 S100
+; CP TOOLCHANGE UNLOAD
+M104 S180 T0
+M104 S210
+G1 E8 F2100
+T1
+M104 S240
+G1 E10 F2100
+G92 E0
+; CP TOOLCHANGE WIPE
+G1 X20 Y5 E1 F1800
+; CP TOOLCHANGE END
+`
+	bare := `
+M83
+T0
+G1 Z0.6 F600
+G1 X5 Y5 E1 F1200
+G1 E-0.8 F2100
+G1 Z0.8 F600
+T1
+M109 S240
+G1 Z0.6 F600
+G1 E0.8 F2100
+G1 X20 Y5 E1 F1800
+`
+	cases := []struct {
+		name  string
+		model string
+		mode  string
+		gcode string
+		opts  Options
+		want  string
+	}{
+		{"prusa A350", ModelA350, PrintModeDefault, prusa, Options{}, `
+M83,T0,;LAYER_CHANGE,;Z:0.4,G1 Z0.4 F720,G1 X10 Y10 E1 F1200,; CP TOOLCHANGE START,; toolchange #1,; material : PLA -> PETG,;--------------------,M220 B,M220 S100,; CP TOOLCHANGE UNLOAD,
+;(Fixed: tool change T0 -> T1),G1 E-10.00000 F2400,G1 Z1.400 F3000,
+G1 X100 Y100 F9000,M104 S170 T0 ; standby T0,
+T1,M109 T1 S240,G1 E10.00000 F2400,
+M220 R,G1 Z0.400 F3000,G1 X110 Y100 F9000,
+; CP TOOLCHANGE WIPE,G1 X120 Y100 E0.5 F1800,; CP TOOLCHANGE END`},
+		{"orca J1", ModelJ1, PrintModeDefault, orca, Options{}, `
+M82,M109 S240 T1,T0,;LAYER_CHANGE,;Z:0.6,G1 X5 Y5 E10 F1200,; CP TOOLCHANGE START,; toolchange #2,; material : PLA -> PETG,;--------------------,M220 B,M220 S100,; CP TOOLCHANGE UNLOAD,
+M104 S180 T0,
+;(Fixed: tool change T0 -> T1),M83,G1 E-0.80000 F2400,M82,
+T1,M83,G1 E0.80000 F2400,M82,
+G1 F2100,G92 E0.00000,
+; CP TOOLCHANGE WIPE,G1 X20 Y5 E1 F1800,; CP TOOLCHANGE END`},
+		{"no tower", ModelA350, PrintModeDefault, bare, Options{}, `
+M83,T0,G1 Z0.6 F600,G1 X5 Y5 E1 F1200,
+;(Fixed: tool change T0 -> T1),G1 E-10.00000 F2400,G1 Z1.600 F3000,
+T1,M109 T1 S240,G1 E1.80000 F300,G1 E10.00000 F2400,
+G1 Z0.600 F3000,G1 F2100,
+G1 X20 Y5 E1 F1800`},
+		{"custom steps", ModelA350, PrintModeDefault, bare, Options{"toolchange.steps": {"toolchange,wait"}}, `
+M83,T0,G1 Z0.6 F600,G1 X5 Y5 E1 F1200,
+;(Fixed: tool change T0 -> T1),T1,M109 T1 S240,
+G1 Z0.600 F3000,G1 F2100,
+G1 X20 Y5 E1 F1800`},
+		{"duplication", ModelJ1, PrintModeDuplication, bare, Options{}, bare},
+	}
+	for _, c := range cases {
+		params := NewParams()
+		params.Model, params.PrintMode = c.model, c.mode
+		params.FilamentTypes = []string{"PLA", "PETG"}
+		params.Retractions = []float64{0.8, 1}
+		if c.model == ModelA350 {
+			params.SwitchRetraction = []float64{10, 10}
+		}
+		result, err := rewriteToolChanges(NewContext(params, c.opts), _parseGcodes(c.gcode))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		want := strings.ReplaceAll(strings.TrimSpace(c.want), "\n", "")
+		if c.want == c.gcode {
+			want = _joinGcodes(_parseGcodes(c.gcode))
+		}
+		if got := _joinGcodes(result); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	if _, err := rewriteToolChanges(NewContext(NewParams(), Options{"toolchange.steps": {"retract,wait"}}), nil); err == nil {
+		t.Error("steps without toolchange: expected an error")
+	}
+
+	purges := []struct {
+		from, to string
+		tower    bool
+		opts     Options
+		want     float64
+	}{
+		{"PLA", "PLA", false, Options{}, 1},
+		{"PLA", "PLA", true, Options{}, 0},
+		{"PLA", "PETG", false, Options{}, 1.8},
+		{"PETG", "PLA", false, Options{}, 1},
+		{"PLA", "PETG", true, Options{"toolchange.purge": {"5"}}, 9},
+		{"pla", "petg", true, Options{"toolchange.purge.PLA-PETG": {"3"}}, 3},
+	}
+	for _, c := range purges {
+		if got := PurgeLength(NewContext(NewParams(), c.opts), c.from, c.to, c.tower); got != c.want {
+			t.Errorf("purge %s-%s: got %g, want %g", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestChangeColors(t *testing.T) {
+	gcode := `
+; filament_type = PLA;PLA;PETG;PLA
+; filament_colour = #FF0000;#00FF00;#0000FF;#FFFFFF
+; filament used [mm] = 10,0,5,0
+M83
+T0
+M104 S210
+G1 Z0.2 F720
+G1 X10 Y10 E1 F1200
+G1 E-0.8 F2100
+T2
+M104 S230
+G1 E0.8 F2100
+G1 X20 Y10 E1 F1200
+M106 P2 S255
+`
+	params := NewParams()
+	params.Retractions = []float64{0.8, 0.8}
+	params.SlicerFilaments = []string{"PLA", "PLA", "PETG", "PLA"}
+	ctx := NewContext(params, nil)
+	var logs bytes.Buffer
+	ctx.Logger = log.New(&logs, "", 0)
+	result, err := changeColors(ctx, _parseGcodes(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `
+; filament_type = PLA;PLA;PETG;PLA,
+; filament_colour = #FF0000;#00FF00;#0000FF;#FFFFFF,
+; filament used [mm] = 15,0,
+M83,;(Fixed: color 1: T0 PLA #FF0000),T0,M104 S210,G1 Z0.2 F720,G1 X10 Y10 E1 F1200,
+;(Fixed: color 2: T2 PETG #0000FF),G1 E-0.80000 F2400,G1 Z10.200 F3000,G0 X0.000 Y0.000 F6000,M117 Load T2 PETG,M300 S440 P200,
+M600,M109 S230,G1 E20.00000 F300,G1 E0.80000 F2400,
+G0 X10.000 Y10.000 F6000,G1 Z0.200 F3000,G1 F2100,
+G1 X20 Y10 E1 F1200,M106 P0 S255`
+	if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(want), "\n", ""); got != want {
+		t.Errorf("\ngot  %s\nwant %s", got, want)
+	}
+	if n := ctx.Changes.Count(""); n == 0 {
+		t.Error("no changes recorded")
+	}
+	if strings.Contains(logs.String(), "warning") {
+		t.Errorf("PLA and PETG are not mixed by the color changes: %s", logs.String())
+	}
+
+	// the header shows the colors
+	tail := _parseGcodes(strings.Repeat(";\n", 20) + "; printer_model = Snapmaker A350\n; first_layer_temperature = 210\n" +
+		"; filament used [mm] = 10, 5\n; nozzle_diameter = 0.4\n")
+	if err := ParseParams(append(result, tail...)); err != nil {
+		t.Fatal(err)
+	}
+	if !Params.SingleNozzle() {
+		t.Errorf("%s prints both filaments by one nozzle", Params.ToolHead)
+	}
+	if got := strings.Join(Params.ColorSequence, " > "); got != "T0 PLA #FF0000 > T2 PETG #0000FF" {
+		t.Errorf("color sequence: %s", got)
+	}
+	if h := string(bytes.Join(headerV0(), []byte("\n"))); !strings.Contains(h, ";color_sequence: T0 PLA #FF0000 > T2 PETG #0000FF\n") {
+		t.Errorf("header: %s", h)
+	}
+
+	// two nozzles
+	params.ToolHead = ToolheadDual
+	if result, _ := changeColors(NewContext(params, nil), _parseGcodes(gcode)); !strings.Contains(_joinGcodes(result), ",T2,") {
+		t.Error("changed the tools of dual extruders")
+	}
+}
+
+func TestConvertIdexMode(t *testing.T) {
+	gcode := `
+M104 S210
+M140 S60
+G28
+M109 S210
+M106 P0 S0
+M104 T1 S0
+T0
+;LAYER_CHANGE
+;Z:0.2
+G1 Z0.2 F600
+G1 X100 Y10 F6000
+G1 X180 Y10 E2 F1200
+M106 S255
+G1 X180 Y50 E3
+M107
+M104 S0
+G1 X0 Y200 F6000
+`
+	cases := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"duplication", Options{"idex.mode": {"duplication"}}, `
+M104 S210,M104 S210 T1 ;(Fixed: T1 follows T0),M140 S60,
+M605 S2 ;(Fixed: IDEX Duplication),G28,
+M104 S210 T1 ;(Fixed: T1 follows T0),M109 S210,M109 S210 T1 ;(Fixed: T1 follows T0),
+M106 P0 S0,M106 P1 S0 ;(Fixed: T1 follows T0),
+;(Fixed: T1 follows T0, remove: M104 T1 S0),
+T0,;LAYER_CHANGE,;Z:0.2,G1 Z0.2 F600,
+G1 X40 Y10 F6000,G1 X120 Y10 E2 F1200,
+M106 S255,M106 S255 P1 ;(Fixed: T1 follows T0),
+G1 X120 Y50 E3,M107,M107 P1 ;(Fixed: T1 follows T0),
+M104 S0,M104 S0 T1 ;(Fixed: T1 follows T0),
+G1 X0 Y200 F6000`},
+		{"mirror fits", Options{"idex.mode": {"Mirror"}, "idex.width": {"200"}, "idex.bed_width": {"400"}}, `
+M104 S210,M104 S210 T1 ;(Fixed: T1 follows T0),M140 S60,
+M605 S3 ;(Fixed: IDEX Mirror),G28,
+M104 S210 T1 ;(Fixed: T1 follows T0),M109 S210,M109 S210 T1 ;(Fixed: T1 follows T0),
+M106 P0 S0,M106 P1 S0 ;(Fixed: T1 follows T0),
+;(Fixed: T1 follows T0, remove: M104 T1 S0),
+T0,;LAYER_CHANGE,;Z:0.2,G1 Z0.2 F600,
+G1 X100 Y10 F6000,G1 X180 Y10 E2 F1200,
+M106 S255,M106 S255 P1 ;(Fixed: T1 follows T0),
+G1 X180 Y50 E3,M107,M107 P1 ;(Fixed: T1 follows T0),
+M104 S0,M104 S0 T1 ;(Fixed: T1 follows T0),
+G1 X0 Y200 F6000`},
+		{"default", Options{"idex.mode": {"default"}}, gcode},
+	}
+	for _, c := range cases {
+		params := NewParams()
+		params.Model = ModelJ1
+		ctx := NewContext(params, c.opts)
+		result, err := convertIdexMode(ctx, _parseGcodes(gcode))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		want := strings.ReplaceAll(strings.TrimSpace(c.want), "\n", "")
+		if c.want == gcode {
+			want = _joinGcodes(_parseGcodes(gcode))
+		}
+		if got := _joinGcodes(result); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	errs := []struct {
+		model string
+		mode  string
+		gcode string
+		opts  Options
+		want  string
+	}{
+		{ModelA350, PrintModeDefault, gcode, Options{"idex.mode": {"duplication"}}, "duplication mode requires Snapmaker J1"},
+		{ModelJ1, PrintModeMirror, gcode, Options{"idex.mode": {"duplication"}}, "already in IDEX Mirror mode"},
+		{ModelJ1, PrintModeDefault, gcode, Options{"idex.mode": {"triple"}}, "unknown idex.mode"},
+		{ModelJ1, PrintModeDefault, gcode + "T1\n", Options{"idex.mode": {"mirror"}}, "only the file printed by T0"},
+		{ModelJ1, PrintModeDefault, gcode, Options{"idex.mode": {"mirror"}, "idex.width": {"60"}}, "the part is 80.0mm wide"},
+		{ModelJ1, PrintModeDefault, gcode, Options{"idex.mode": {"mirror"}, "idex.shift": {"false"}}, "out of X 0 to 160"},
+		{ModelJ1, PrintModeDefault, gcode, Options{"idex.mode": {"mirror"}, "idex.width": {"200"}}, "mirrored to X 144.0 to 224.0, the heads collide"},
+		{ModelJ1, PrintModeDefault, gcode, Options{"idex.mode": {"mirror"}, "idex.bed_width": {"100"}}, "out of the bed"},
+	}
+	for _, c := range errs {
+		params := NewParams()
+		params.Model, params.PrintMode = c.model, c.mode
+		_, err := convertIdexMode(NewContext(params, c.opts), _parseGcodes(c.gcode))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: got %v, want %q", c.opts, err, c.want)
+		}
+	}
+}
+
+func TestParseParamsIdex(t *testing.T) {
+	gcode := `
+; generated by PrusaSlicer 2.7.1
+M605 S2
+` + strings.Repeat("G1 X1 E1\n", 20) + `
+; filament used [mm] = 1000.00
+; filament used [g] = 2.98
+; filament_type = PLA;PETG
+; first_layer_temperature = 210,0
+; first_layer_bed_temperature = 60,0
+; nozzle_diameter = 0.4,0.4
+; printer_model = Snapmaker J1
+`
+	if err := ParseParams(_parseGcodes(gcode)); err != nil {
+		t.Fatal(err)
+	}
+	p := Params
+	if p.PrintMode != PrintModeDuplication || p.Model != ModelJ1 || !p.RightExtruderUsed {
+		t.Fatalf("got %s %s %v", p.PrintMode, p.Model, p.RightExtruderUsed)
+	}
+	if p.FilamentTypes[1] != "PLA" || p.NozzleTemperatures[1] != 210 || p.FilamentUsedWeight[1] != 2.98 || p.AllFilamentUsed() != 2000 {
+		t.Errorf("T1 does not follow T0: %v %v %v", p.FilamentTypes, p.NozzleTemperatures, p.FilamentUsedWeight)
+	}
+	if h := string(bytes.Join(headerV1(), []byte("\n"))); !strings.Contains(h, ";Extruder Mode:IDEX Duplication") || !strings.Contains(h, ";Extruder(s) Used:2") {
+		t.Errorf("header: %s", h)
+	}
+}
+
+func TestParseParamsFilamentWeight(t *testing.T) {
+	// no weight is made up from an unknown length
+	for _, used := range []string{"", "; filament used [mm] = 1000.00\n"} {
+		gcode := `
+; generated by PrusaSlicer 2.7.1
+M605 S4
+` + strings.Repeat("G1 X1 E1\n", 20) + used + `
+; filament_type = PLA;PLA
+; first_layer_temperature = 210,210
+; nozzle_diameter = 0.4,0.4
+; printer_model = Snapmaker J1
+`
+		if err := ParseParams(_parseGcodes(gcode)); err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range Params.FilamentUsedWeight {
+			if Params.FilamentUsed[i] <= 0 && w != -1 {
+				t.Errorf("%q: weight of T%d is %g, used %v", used, i, w, Params.FilamentUsed)
+			}
+		}
+	}
+}
+
+func TestConvertIdexBackup(t *testing.T) {
+	gcode := `
+M104 S210
+G28
+M109 S210
+T0
+;LAYER_CHANGE
+;Z:0.2
+G1 X10 Y10 F6000
+G1 X300 Y10 E2 F1200
+`
+	want := `
+M104 S210,M104 S210 T1 ;(Fixed: T1 follows T0),
+M605 S4 ;(Fixed: IDEX Backup),M412 S1 ;(Fixed: IDEX Backup),G28,
+M104 S210 T1 ;(Fixed: T1 follows T0),M109 S210,M109 S210 T1 ;(Fixed: T1 follows T0),
+T0,;LAYER_CHANGE,;Z:0.2,G1 X10 Y10 F6000,G1 X300 Y10 E2 F1200`
+
+	cases := []struct {
+		types []string
+		opts  Options
+		err   string
+	}{
+		{[]string{"PLA", "PLA"}, Options{}, ""},
+		{[]string{"PETG", " petg"}, Options{}, ""},
+		{[]string{"PLA", ""}, Options{"idex.backup_material": {"PLA"}}, ""},
+		{[]string{"PLA", "PETG"}, Options{}, "T0 is PLA but T1 is PETG"},
+		{[]string{"PLA", "PLA"}, Options{"idex.backup_material": {"TPU"}}, "T0 is PLA but T1 is TPU"},
+		{[]string{"PLA", ""}, Options{}, "needs the filament types of both extruders"},
+		{[]string{"PLA"}, Options{}, "needs the filament types of both extruders"},
+	}
+	for _, c := range cases {
+		params := NewParams()
+		params.Model = ModelJ1
+		params.SlicerFilaments = c.types
+		c.opts.Add("idex.mode", "backup")
+		ctx := NewContext(params, c.opts)
+		result, err := convertIdexMode(ctx, _parseGcodes(gcode))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: got %v, want %q", c.types, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %s", c.types, err)
+		}
+		if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(want), "\n", ""); got != want {
+			t.Errorf("%v:\ngot  %s\nwant %s", c.types, got, want)
+		}
+		if ctx.Params.PrintMode != PrintModeBackup {
+			t.Errorf("print mode: got %s", ctx.Params.PrintMode)
+		}
+	}
+
+	// header
+	gcode = `
+; generated by PrusaSlicer 2.7.1
+M605 S4
+` + strings.Repeat("G1 X1 E1\n", 20) + `
+; filament used [mm] = 1000.00
+; filament_type = PLA;PLA
+; first_layer_temperature = 210,210
+; printer_model = Snapmaker J1
+`
+	if err := ParseParams(_parseGcodes(gcode)); err != nil {
+		t.Fatal(err)
+	}
+	if Params.PrintMode != PrintModeBackup || Params.AllFilamentUsed() != 1000 || Params.FilamentTypes[1] != "PLA" {
+		t.Errorf("got %s %g %v", Params.PrintMode, Params.AllFilamentUsed(), Params.FilamentTypes)
+	}
+	if h := string(bytes.Join(headerV1(), []byte("\n"))); !strings.Contains(h, ";Extruder Mode:IDEX Backup") {
+		t.Errorf("header: %s", h)
+	}
+}
+
+func TestNormalizeFans(t *testing.T) {
+	gcode := `
+T0
+M106 S200
+G1 X1 E1
+T1
+G1 X2 E1
+M107
+T0
+M106 P0 S100
+G1 X3 E1
+T1
+`
+	cases := []struct {
+		name string
+		head string
+		opts Options
+		want string
+	}{
+		{"dual", ToolheadDual, Options{}, `
+T0,M106 S200 P0 ;(Fixed: fan of T0),G1 X1 E1,
+T1,M106 P1 S200 ;(Fixed: fan of T1),G1 X2 E1,M107 P1 ;(Fixed: fan of T1),
+T0,M106 P0 S100,G1 X3 E1,
+T1,M106 P1 S100 ;(Fixed: fan of T1)`},
+		{"idle off", ToolheadDual, Options{"fan.idle_off": {"true"}}, `
+T0,M106 S200 P0 ;(Fixed: fan of T0),G1 X1 E1,
+T1,M107 P0 ;(Fixed: idle fan of T0),M106 P1 S200 ;(Fixed: fan of T1),G1 X2 E1,M107 P1 ;(Fixed: fan of T1),
+T0,M106 P0 S100,G1 X3 E1,
+T1,M107 P0 ;(Fixed: idle fan of T0),M106 P1 S100 ;(Fixed: fan of T1)`},
+		{"single", ToolheadSingle, Options{}, `
+T0,M106 S200,G1 X1 E1,T1,G1 X2 E1,M107,T0,M106 P0 S100,G1 X3 E1,T1`},
+		{"shared fan", ToolheadDual, Options{"fan.map": {"T0:0, T1:0"}}, `
+T0,M106 S200 P0 ;(Fixed: fan of T0),G1 X1 E1,T1,G1 X2 E1,M107 P0 ;(Fixed: fan of T1),T0,M106 P0 S100,G1 X3 E1,T1`},
+	}
+	for _, c := range cases {
+		params := NewParams()
+		params.ToolHead = c.head
+		result, err := normalizeFans(NewContext(params, c.opts), _parseGcodes(gcode))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(c.want), "\n", ""); got != want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	// the slicer sets the fan of the new tool
+	result, _ := normalizeFans(NewContext(&slicerParams{ToolHead: ToolheadDual}, nil), _parseGcodes("T0\nM106 P0 S255\nT1\nM106 P1 S80\nG1 X1 E1"))
+	if got := _joinGcodes(result); got != "T0,M106 P0 S255,T1,M106 P1 S80,G1 X1 E1" {
+		t.Errorf("got %s", got)
+	}
+
+	// the comment of the slicer is kept before the tag
+	result, _ = normalizeFans(NewContext(&slicerParams{ToolHead: ToolheadDual}, nil), _parseGcodes("T1\nM106 S255 ; bridge"))
+	if got := _joinGcodes(result); got != "T1,M106 S255 P1 ; bridge ;(Fixed: fan of T1)" {
+		t.Errorf("got %s", got)
+	}
+
+	for _, v := range []string{"0", "0:a", "-1:0", "0:99"} {
+		if _, err := NewFanMap(NewContext(NewParams(), Options{"fan.map": {v}})); err == nil {
+			t.Errorf("fan.map %q: expected an error", v)
+		}
+	}
+}
+
+func TestInjectCommands(t *testing.T) {
+	gcode := `
+M83
+;LAYER_CHANGE
+;Z:0.2
+G1 Z0.2
+G1 X1 E1
+;LAYER_CHANGE
+;Z:0.4
+G1 Z0.4
+G1 X2 E1
+;LAYER_CHANGE
+;Z:0.6
+G1 Z0.6
+G1 X3 E1
+;LAYER_CHANGE
+;Z:0.8
+G1 Z0.8
+G1 X4 E1
+M104 S0
+`
+	opts := Options{"inject": {
+		"at z=0.5: M600",
+		"before layer 2: M106 S255 ; full",
+		"Every 2 layers: G28 X Y | M117 Homed",
+		"after layer 4: M300",
+		"after layer 9: M300",
+	}}
+	ctx := NewContext(NewParams(), opts)
+	pipeline, _ := NewPipeline("inject")
+	result, err := pipeline.Run(ctx, _parseGcodes(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `
+M83,;LAYER_CHANGE,;Z:0.2,G1 Z0.2,G1 X1 E1,
+M106 S255 ; full ;(Fixed: inject before layer 2),
+;LAYER_CHANGE,;Z:0.4,G1 Z0.4,G1 X2 E1,
+M600  ;(Fixed: inject at Z0.5),G28 X Y ;(Fixed: inject every 2 layers),M117 Homed ;(Fixed: inject every 2 layers),
+;LAYER_CHANGE,;Z:0.6,G1 Z0.6,G1 X3 E1,;LAYER_CHANGE,;Z:0.8,G1 Z0.8,G1 X4 E1,
+M300  ;(Fixed: inject after layer 4),
+M104 S0`
+	if got, want := _joinGcodes(result), strings.ReplaceAll(strings.TrimSpace(want), "\n", ""); got != want {
+		t.Errorf("\ngot  %s\nwant %s", got, want)
+	}
+	summary := strings.Join(ctx.Changes.Summary(), "\n")
+	for _, s := range []string{"inject: 4 changes\n", "  line 10: inject at Z0.5 (layer 3): M600\n", "  line 18: inject after layer 4 (layer 4): M300"} {
+		if !strings.Contains(summary, s) {
+			t.Errorf("summary %q has no %q", summary, s)
+		}
+	}
+
+	for _, s := range []string{"at z=abc: M600", "layer 0: M600", "every 5 layers", "before layer 2: ", "before layer 2: | "} {
+		if _, err := ParseInjection(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestFitArcs(t *testing.T) {
+	// moves on a circle around (50, 50), r = 10, from angle a0 to a1
+	circle := func(relE bool, a0, a1 float64, segments int) (string, []Point) {
+		var (
+			b      strings.Builder
+			points []Point
+			e      float64
+		)
+		if relE {
+			b.WriteString("M83\n")
+		} else {
+			b.WriteString("M82\n")
+		}
+		x, y := 50+10*math.Cos(a0), 50+10*math.Sin(a0)
+		fmt.Fprintf(&b, "G1 X%.3f Y%.3f F9000\n", x, y)
+		points = append(points, Point{math.Round(x*1000) / 1000, math.Round(y*1000) / 1000})
+		for i := 1; i <= segments; i++ {
+			a := a0 + (a1-a0)*float64(i)/float64(segments)
+			x, y := 50+10*math.Cos(a), 50+10*math.Sin(a)
+			step := 0.05
+			e += step
+			if !relE {
+				step = e
+			}
+			if i == 1 {
+				fmt.Fprintf(&b, "G1 X%.3f Y%.3f E%.5f F1800 ; perimeter\n", x, y, step)
+			} else {
+				fmt.Fprintf(&b, "G1 X%.3f Y%.3f E%.5f\n", x, y, step)
+			}
+			points = append(points, Point{math.Round(x*1000) / 1000, math.Round(y*1000) / 1000})
+		}
+		b.WriteString("G1 E-0.8\n")
+		return b.String(), points
+	}
+
+	for _, c := range []struct {
+		name     string
+		relE     bool
+		a0, a1   float64
+		segments int
+		cmd      string
+		e        float64
+	}{
+		{"ccw relative", true, 0, math.Pi / 2, 20, "G3", 1},
+		{"cw absolute", false, math.Pi, -math.Pi / 3, 40, "G2", 2},
+	} {
+		gcode, points := circle(c.relE, c.a0, c.a1, c.segments)
+		ctx := NewContext(NewParams(), Options{"arcfit.tolerance": {"0.02"}})
+		result, err := fitArcs(ctx, _parseGcodes(gcode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 4 || !result[2].Is(c.cmd) {
+			t.Fatalf("%s: %s", c.name, _joinGcodes(result))
+		}
+		arc := result[2]
+		var x, y, i, j, e, f float64
+		for _, p := range []struct {
+			word byte
+			v    *float64
+		}{{'X', &x}, {'Y', &y}, {'I', &i}, {'J', &j}, {'E', &e}, {'F', &f}} {
+			v, ok := arc.paramFloat(p.word)
+			if !ok {
+				t.Fatalf("%s: %s has no %c", c.name, arc, p.word)
+			}
+			*p.v = v
+		}
+		// round trip: the moves are on the arc
+		a := Arc{Start: points[0], Center: Point{points[0].X + i, points[0].Y + j}}
+		if d := a.Deviation(points...); d > 0.02 {
+			t.Errorf("%s: deviation %.4f of %s", c.name, d, arc)
+		}
+		if last := points[len(points)-1]; x != last.X || y != last.Y {
+			t.Errorf("%s: ends at %g,%g, want %v", c.name, x, y, last)
+		}
+		if math.Abs(e-c.e) > 1e-5 || f != 1800 || arc.Comment() != "; perimeter" {
+			t.Errorf("%s: %s", c.name, arc)
+		}
+		if ctx.Changes.Count("") != 1 {
+			t.Errorf("%s: %d changes", c.name, ctx.Changes.Count(""))
+		}
+	}
+
+	// lines, corners, travels and changes of flow are kept
+	for _, gcode := range []string{
+		"G1 X0 Y0\nG1 X1 Y0 E1\nG1 X2 Y0 E1\nG1 X3 Y0 E1\nG1 X4 Y0 E1",
+		"G1 X0 Y0\nG1 X10 Y0 E1\nG1 X10 Y10 E1\nG1 X0 Y10 E1\nG1 X0 Y0 E1",
+		"G1 X60 Y50\nG1 X59.511 Y53.09\nG1 X58.09 Y55.878\nG1 X55.878 Y58.09",
+		"M83\nG1 X60 Y50\nG1 X59.511 Y53.09 E0.1\nG1 X58.09 Y55.878 E0.3\nG1 X55.878 Y58.09 E0.1",
+		"M83\nG1 X60 Y50\nG1 X59.511 Y53.09 E0.1\nG1 X58.09 Y55.878 E0.1 ; gap\nG1 X55.878 Y58.09 E0.1",
+	} {
+		want := _joinGcodes(_parseGcodes(gcode))
+		result, _ := fitArcs(NewContext(NewParams(), nil), _parseGcodes(gcode))
+		if got := _joinGcodes(result); got != want {
+			t.Errorf("got  %s\nwant %s", got, want)
+		}
+	}
+
+	// the arc of a quarter circle
+	if a, ok := fitArc([]Point{{10, 0}, {7.071, 7.071}, {0, 10}}, 1); !ok || math.Abs(a.Sweep-math.Pi/2) > 1e-3 || a.Center.Dist(Point{}) > 1e-3 {
+		t.Errorf("fitArc: %+v %v", a, ok)
+	}
+}
+
+func TestExpandArcs(t *testing.T) {
+	arcOf := func(gcode string) (ArcMove, error) {
+		var (
+			state = NewMachineState()
+			plane = PlaneXY
+			g     *GcodeBlock
+		)
+		for _, g = range _parseGcodes(gcode) {
+			prev := state
+			state.Update(g)
+			switch {
+			case g.Is("G18"):
+				plane = PlaneZX
+			case g.Is("G19"):
+				plane = PlaneYZ
+			case g.Is("G2"), g.Is("G3"):
+				return NewArcMove(g, plane, prev, state)
+			}
+		}
+		return ArcMove{}, fmt.Errorf("no arc")
+	}
+	for _, c := range []struct {
+		gcode  string
+		center Point
+		sweep  float64
+	}{
+		{"G1 X0 Y0\nG2 X10 Y0 I5 J0", Point{5, 0}, -math.Pi},
+		{"G1 X0 Y0\nG3 X10 Y0 I5", Point{5, 0}, math.Pi},
+		{"G1 X0 Y0\nG2 X10 Y10 R10", Point{10, 0}, -math.Pi / 2},
+		{"G1 X0 Y0\nG2 X10 Y10 R-10", Point{0, 10}, -3 * math.Pi / 2},
+		{"G1 X0 Y0\nG3 X10 Y10 R10", Point{0, 10}, math.Pi / 2},
+		{"G1 X0 Y0\nG3 I5 J0", Point{5, 0}, 2 * math.Pi},
+		{"G1 X0 Y0 Z0\nG18\nG3 X10 Z0 I5 K0", Point{0, 5}, math.Pi},  // Z-X plane
+		{"G1 X0 Y0 Z0\nG19\nG2 Y0 Z10 J0 K5", Point{0, 5}, -math.Pi}, // Y-Z plane
+	} {
+		m, err := arcOf(c.gcode)
+		if err != nil {
+			t.Errorf("%q: %s", c.gcode, err)
+			continue
+		}
+		if m.Center.Dist(c.center) > 1e-9 || math.Abs(m.Sweep-c.sweep) > 1e-9 {
+			t.Errorf("%q: center %v sweep %g, want %v %g", c.gcode, m.Center, m.Sweep, c.center, c.sweep)
+		}
+		// the chords are within the tolerance
+		points := append([]Point{m.Start}, m.Segments(0.01)...)
+		for i := 1; i < len(points); i++ {
+			mid := Point{(points[i-1].X + points[i].X) / 2, (points[i-1].Y + points[i].Y) / 2}
+			if d := m.Deviation(points[i], mid); d > 0.01+1e-9 {
+				t.Errorf("%q: chord %d is %.4f off", c.gcode, i, d)
+			}
+		}
+		if end := points[len(points)-1]; end.Dist(m.End()) > 1e-9 {
+			t.Errorf("%q: ends at %v", c.gcode, end)
+		}
+	}
+	for _, gcode := range []string{"G2 X10 Y0", "G1 X5 Y5\nG2 X5 Y5 R10"} {
+		if _, err := arcOf(gcode); err == nil {
+			t.Errorf("%q: want an error", gcode)
+		}
+	}
+
+	// E is split, F and the comment are on the first chord
+	for _, gcode := range []string{
+		"M83\nG1 X0 Y0 F3000\nG2 X10 Y0 I5 J0 E2 F1200 ; wall",
+		"M82\nG92 E5\nG1 X0 Y0 F3000\nG2 X10 Y0 I5 J0 E7 F1200 ; wall",
+		"G1 X0 Y0 F3000\nG91\nG2 X10 Y0 I5 J0 E2 F1200 ; wall",
+	} {
+		ctx := NewContext(NewParams(), Options{"arcexpand.tolerance": {"0.05"}})
+		result, err := expandArcs(ctx, _parseGcodes(gcode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			state = NewMachineState()
+			e     float64
+			n     int
+		)
+		for _, g := range result {
+			prev := state
+			state.Update(g)
+			if g.Is("G2") || g.Is("G3") {
+				t.Fatalf("%q: %s is left", gcode, g)
+			}
+			if !g.Is("G1") || prev.F != 1200 && !strings.Contains(g.Comment(), "Fixed") {
+				continue // before the arc
+			}
+			if n == 0 {
+				if state.F != 1200 || !strings.HasPrefix(g.Comment(), "; wall ;(Fixed: G2 to ") {
+					t.Errorf("%q: first chord %s", gcode, g)
+				}
+			} else if g.HasParam('F') {
+				t.Errorf("%q: chord %s has F", gcode, g)
+			}
+			if d := math.Abs(Point{state.X, state.Y}.Dist(Point{5, 0}) - 5); d > 0.05 {
+				t.Errorf("%q: chord to %g,%g is off the arc", gcode, state.X, state.Y)
+			}
+			e += state.E - prev.E
+			n++
+		}
+		if n < 10 || math.Abs(e-2) > 1e-5 || math.Abs(state.X-10) > 1e-9 || state.Y != 0 {
+			t.Errorf("%q: %d chords, E %g, at %g,%g: %s", gcode, n, e, state.X, state.Y, _joinGcodes(result))
+		}
+		if ctx.Changes.Count("") != 1 {
+			t.Errorf("%q: %d changes", gcode, ctx.Changes.Count(""))
+		}
+	}
+
+	// the large arcs are kept by arcexpand.radius
+	gcode := "G1 X0 Y0\nG2 X10 Y0 I5 J0 E2"
+	result, _ := expandArcs(NewContext(NewParams(), Options{"arcexpand.radius": {"5"}}), _parseGcodes(gcode))
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(gcode)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	gcode := `
+G1 X1 Y1 F3000
+G4 S0
+G28
+T0
+G1 X0 Y0 Z0.2 F3000
+G1 X0 Y0
+G1 X10 Y0 E1 F3000
+G1 X20 Y0 E1 F1200
+G1 X20 Y0 F1200 ;
+;
+M104 S200
+M104 S200
+M104 T1 S200
+M104 S210 ; keep
+M109 S210
+M104 S210
+M106 S255
+M106
+M107
+M107
+M140 S60
+M140 S60
+G1 X30 Y0
+G1 X40 Y0
+G1 X50 Y0 F9000
+G1 X60 Y10
+G1 X70 Y20
+; travel
+G1 X80 Y30
+G4 P0 ; wait
+M83
+G1 E0
+G1 E0.5
+`
+	want := `
+G1 X1 Y1 F3000
+G28
+T0
+G1 X0 Y0 Z0.2
+G1 X10 Y0 E1
+G1 X20 Y0 E1 F1200
+M104 S200
+M104 T1 S200
+M104 S210 ; keep
+M109 S210
+M106 S255
+M107
+M140 S60
+G1 X40 Y0
+G1 X50 Y0 F9000
+G1 X70 Y20
+; travel
+G1 X80 Y30
+G4 P0 ; wait
+M83
+G1 E0.5
+`
+	var logs bytes.Buffer
+	ctx := NewContext(NewParams(), nil)
+	ctx.Logger = log.New(&logs, "", 0)
+	result, err := optimize(ctx, _parseGcodes(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(want)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	// G4 S0 and the newline
+	if !strings.Contains(logs.String(), "dwell: 1 lines, 6 bytes") || ctx.Changes.Count("") == 0 {
+		t.Errorf("stats: %s", logs.String())
+	}
+
+	// the rules can be turned off
+	options := Options{}
+	for _, r := range OptimizeRules {
+		options.Add("optimize."+r, "false")
+	}
+	result, _ = optimize(NewContext(NewParams(), options), _parseGcodes(gcode))
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(gcode)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	result, _ = optimize(NewContext(NewParams(), Options{"optimize.travels": {"false"}}), _parseGcodes("G28\nG1 X1\nG1 X2\nG1 X3"))
+	if got := _joinGcodes(result); got != "G28,G1 X1,G1 X2,G1 X3" {
+		t.Errorf("travels: %s", got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	gcode := `
+; generated by PrusaSlicer 2.6.0
+; thumbnail begin 16x16 100
+; iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAAFklEQVR4nGP8z8DwnwEJMDIwMDAwAAUAEwP/cA==
+; thumbnail end
+M104 S210 ; set temperature
+;LAYER_CHANGE
+;Z:0.2
+;(Fixed: color 1: T0 PLA)
+;TYPE:Perimeter
+G1 X10 Y10 E1 ; perimeter
+G1 X20 Y10 E2
+; filament used [mm] = 10
+; prusaslicer_config = begin
+` + strings.Repeat("; setting = value\n", 20) + `; printer_model = Snapmaker A350
+; first_layer_temperature = 210
+; nozzle_diameter = 0.4
+; prusaslicer_config = end
+`
+	want := `
+M104 S210
+;LAYER_CHANGE
+;Z:0.2
+;(Fixed: color 1: T0 PLA)
+G1 X10 Y10 E1
+G1 X20 Y10 E2
+`
+	gcodes := _parseGcodes(gcode)
+	result := Compact(gcodes)
+	if got, want := _joinGcodes(result), _joinGcodes(_parseGcodes(want)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if gcodes[4].Comment() == "" {
+		t.Error("the input is changed")
+	}
+
+	// the header is extracted before, the lines are counted after
+	if _, err := ExtractHeader(gcodes); err != nil {
+		t.Fatal(err)
+	}
+	Params.TotalLines = len(result)
+	var out bytes.Buffer
+	if err := WriteGcode(&out, Header(), result, LF); err != nil {
+		t.Fatal(err)
+	}
+	h := out.String()
+	if !strings.Contains(h, fmt.Sprintf(";file_total_lines: %d\n", strings.Count(h, "\n"))) || !strings.Contains(h, ";thumbnail: data:image/png;base64,") {
+		t.Errorf("header: %s", h)
+	}
+}
+
+func TestWriteGcode(t *testing.T) {
+	body := `
+; generated by PrusaSlicer 2.6.0
+;(Fixed: color 1: T0 PLA)
+;(Fixed: color 2: T1 PETG)
+M104 S210
+G1 X10 Y10 E1
+; filament used [mm] = 10
+` + strings.Repeat("; setting = value\n", 20) + `; first_layer_temperature = 210
+; nozzle_diameter = 0.4
+`
+	thumbnail := `
+; thumbnail begin 16x16 100
+; iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAAFklEQVR4nGP8z8DwnwEJMDIwMDAwAAUAEwP/cA==
+; thumbnail end
+`
+	for _, c := range []struct {
+		name, gcode, count string
+	}{
+		{"v0", body + "; printer_model = Snapmaker A350\n", ";file_total_lines: "},
+		{"v0 thumbnail", thumbnail + body + "; printer_model = Snapmaker A350\n", ";file_total_lines: "},
+		{"v1", "; SNAPMAKER_GCODE_V1\n" + body + "; printer_model = Snapmaker J1\n", ";Lines:"},
+		{"v1 thumbnail", thumbnail + body + "; printer_model = Snapmaker J1\n", ";Lines:"},
+	} {
+		gcodes := _parseGcodes(c.gcode)
+		// lines are inserted after the params are parsed
+		if err := ParseParams(gcodes); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		gcodes = append(gcodes, _parseGcodes("M107\nM84")...)
+
+		headers, err := ExtractHeader(gcodes)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		var out bytes.Buffer
+		if err := WriteGcode(&out, headers, gcodes, LF); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			lines = 0
+			count = -1
+			sc    = bufio.NewScanner(&out)
+		)
+		for sc.Scan() {
+			lines++
+			if v, ok := strings.CutPrefix(sc.Text(), c.count); ok {
+				fmt.Sscan(v, &count)
+			}
+		}
+		if count != lines {
+			t.Errorf("%s: %s%d, but %d lines are written", c.name, c.count, count, lines)
+		}
+	}
+}
+
+func TestReadGcode(t *testing.T) {
+	want := "; generated by PrusaSlicer,G1 X1 Y1,; Température,M104 S200"
+	for _, c := range []struct {
+		name, source, eol string
+	}{
+		{"lf", "; generated by PrusaSlicer\nG1 X1 Y1\n\n; Température\nM104 S200\n", LF},
+		{"crlf", "; generated by PrusaSlicer\r\nG1 X1 Y1\r\n\r\n; Température\r\nM104 S200\r\n", CRLF},
+		{"cr", "; generated by PrusaSlicer\rG1 X1 Y1\r\r; Température\rM104 S200", CR},
+		{"bom", "\xEF\xBB\xBF; generated by PrusaSlicer\r\nG1 X1 Y1\r\n; Température\r\nM104 S200", CRLF},
+		{"latin-1", "; generated by PrusaSlicer\r\nG1 X1 Y1\r\n; Temp\xe9rature\r\nM104 S200\r\n", CRLF},
+		{"mixed", "; generated by PrusaSlicer\nG1 X1 Y1\r\n; Temp\xe9rature\rM104 S200\n", LF},
+	} {
+		gcodes, eol, err := ReadGcode(strings.NewReader(c.source))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got := _joinGcodes(gcodes); got != want || eol != c.eol {
+			t.Errorf("%s: got %q %q\nwant %q %q", c.name, got, eol, want, c.eol)
+		}
+	}
+
+	// a "\r\n" across the buffer of the scanner
+	source := strings.Repeat("G1 X1\r\n", 10000)
+	if gcodes, _, err := ReadGcode(iotest.OneByteReader(strings.NewReader(source))); err != nil || len(gcodes) != 10000 {
+		t.Errorf("%d lines, %v", len(gcodes), err)
+	}
+
+	if _, _, err := ReadGcode(strings.NewReader("G1 X1\n" + Mark + "\n")); err != ErrIsFixed {
+		t.Errorf("got %v, want ErrIsFixed", err)
+	}
+
+	// write back in the line ending of the input
+	for _, eol := range []string{CRLF, CR} {
+		gcodes, got, _ := ReadGcode(strings.NewReader("G1 X1" + eol + "G1 X2" + eol))
+		if got != eol {
+			t.Errorf("%q: got %q", eol, got)
+		}
+		var out bytes.Buffer
+		if err := WriteGcode(&out, [][]byte{H(";Header Start"), H(";Header End\n\n")}, gcodes, got); err != nil {
+			t.Fatal(err)
+		}
+		want := strings.ReplaceAll(";Header Start\n;Header End\n\nG1 X1\nG1 X2\n", LF, eol)
+		if out.String() != want {
+			t.Errorf("got %q, want %q", out.String(), want)
+		}
+	}
+}
+
+func TestReadGcodeLongLines(t *testing.T) {
+	long := "; printer_notes = " + strings.Repeat("A", 1<<20)
+	for _, eol := range []string{LF, CRLF} {
+		source := "G1 X1" + eol + long + eol + "G1 X2" + eol
+		gcodes, _, err := ReadGcode(strings.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gcodes) != 3 || gcodes[1].Comment() != long || gcodes[2].String() != "G1 X2" {
+			t.Errorf("%q: %d lines", eol, len(gcodes))
+		}
+	}
+
+	defer func(max int) { MaxLineSize = max }(MaxLineSize)
+	MaxLineSize = 512 << 10
+	for _, source := range []string{
+		"G1 X1\n" + long + "\nG1 X2\n",
+		"G1 X1\r\n" + long,
+		"G1 X1\n" + strings.Repeat("A", MaxLineSize+1) + "\n",
+	} {
+		_, _, err := ReadGcode(strings.NewReader(source))
+		if !errors.Is(err, ErrLineTooLong) || !strings.HasPrefix(err.Error(), "line 2: ") {
+			t.Errorf("got %v, want ErrLineTooLong at line 2", err)
+		}
+	}
+	if gcodes, _, err := ReadGcode(strings.NewReader("G1 X1\r\n;" + strings.Repeat("A", MaxLineSize-1) + "\r\n")); err != nil || len(gcodes) != 2 {
+		t.Errorf("a line of MaxLineSize: %d lines, %v", len(gcodes), err)
+	}
+}
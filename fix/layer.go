@@ -0,0 +1,179 @@
+package fix
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+type Layer struct {
+	Index     int // from 0
+	Z         float64
+	Height    float64
+	StartLine int // index of the line which starts the layer
+	EndLine   int // index of the last line of the layer
+	Tools     []int32
+}
+
+// LayerIndex is the result of DetectLayers
+type LayerIndex struct {
+	layers []Layer
+}
+
+// layerMark is a comment about layers, kind is empty if the comment does not start a layer
+type layerMark struct {
+	kind string
+	z    float64
+}
+
+// layerMarker recognises layer comments of slicers:
+//
+//	PrusaSlicer/SuperSlicer/OrcaSlicer: ;LAYER_CHANGE ;Z:0.4
+//	BambuStudio/OrcaSlicer: ; CHANGE_LAYER ; Z_HEIGHT: 0.4
+//	Cura: ;LAYER:1
+//
+// ;Z: starts a layer only if it is the first kind of marker in the file.
+func layerMarker(g *GcodeBlock) (m layerMark) {
+	if !g.IsComment() {
+		return
+	}
+	c := g.Comment()
+	switch {
+	case strings.HasPrefix(c, ";LAYER_CHANGE"):
+		m.kind = "LAYER_CHANGE"
+	case strings.HasPrefix(c, "; CHANGE_LAYER"):
+		m.kind = "CHANGE_LAYER"
+	case strings.HasPrefix(c, ";LAYER:"):
+		m.kind = "LAYER:"
+	case strings.HasPrefix(c, ";Z:"):
+		m.kind = "Z:"
+		m.z = parseFloat(strings.TrimSpace(c[3:]))
+	case strings.HasPrefix(c, "; Z_HEIGHT:"):
+		m.z = parseFloat(strings.TrimSpace(c[11:]))
+	}
+	return
+}
+
+// DetectLayers finds layers by the comments of slicers,
+// or by Z changes of extrusion moves if there is no comment.
+func DetectLayers(gcodes []*GcodeBlock) *LayerIndex {
+	li := &LayerIndex{}
+	if !li.detectByMarkers(gcodes) {
+		li.detectByMoves(gcodes)
+	}
+
+	for i := range li.layers {
+		l := &li.layers[i]
+		l.Z = math.Round(l.Z*1e6) / 1e6
+		if i+1 < len(li.layers) {
+			l.EndLine = li.layers[i+1].StartLine - 1
+		} else {
+			l.EndLine = len(gcodes) - 1
+		}
+		if i == 0 {
+			l.Height = l.Z
+		} else {
+			l.Height = l.Z - li.layers[i-1].Z
+		}
+		l.Height = math.Round(l.Height*1e6) / 1e6
+	}
+	return li
+}
+
+func (li *LayerIndex) detectByMarkers(gcodes []*GcodeBlock) bool {
+	var (
+		state = NewMachineState()
+		cur   *Layer
+		zSet  bool // Z of the current layer is from a comment
+	)
+	for n, g := range gcodes {
+		layer, layerZ, e := state.Layer, state.LayerZ, state.E
+		state.Update(g)
+
+		if state.Layer != layer {
+			li.layers = append(li.layers, Layer{Index: len(li.layers), StartLine: n})
+			cur = &li.layers[len(li.layers)-1]
+			zSet = false
+		}
+		if cur == nil {
+			continue
+		}
+		if state.LayerZ != layerZ || layerMarker(g).z > 0 {
+			cur.Z = state.LayerZ
+			zSet = true
+		}
+		if isExtruding(g, state.E, e) {
+			if !zSet && cur.Z == 0 {
+				cur.Z = state.Z
+			}
+			cur.addTool(state.Tool)
+		}
+	}
+	return len(li.layers) > 0
+}
+
+func (li *LayerIndex) detectByMoves(gcodes []*GcodeBlock) {
+	var (
+		state = NewMachineState()
+		cur   *Layer
+		zLine int // the last line which changed Z
+	)
+	for n, g := range gcodes {
+		z, e := state.Z, state.E
+		state.Update(g)
+		if state.Z != z {
+			zLine = n
+		}
+		if !isExtruding(g, state.E, e) {
+			continue
+		}
+		if cur == nil || math.Abs(state.Z-cur.Z) > 1e-4 {
+			start := zLine
+			if cur != nil && start <= cur.StartLine {
+				start = n
+			}
+			li.layers = append(li.layers, Layer{Index: len(li.layers), Z: state.Z, StartLine: start})
+			cur = &li.layers[len(li.layers)-1]
+		}
+		cur.addTool(state.Tool)
+	}
+}
+
+func isExtruding(g *GcodeBlock, e, prevE float64) bool {
+	return e > prevE && (g.Is("G1") || g.Is("G0") || g.Is("G2") || g.Is("G3"))
+}
+
+func (l *Layer) addTool(t int32) {
+	if t < 0 {
+		t = 0
+	}
+	for _, tool := range l.Tools {
+		if tool == t {
+			return
+		}
+	}
+	l.Tools = append(l.Tools, t)
+}
+
+func (li *LayerIndex) Layers() []Layer {
+	return li.layers
+}
+
+func (li *LayerIndex) Len() int {
+	return len(li.layers)
+}
+
+// At returns index of the layer of line n, -1 if the line is before the first layer
+func (li *LayerIndex) At(n int) int {
+	return sort.Search(len(li.layers), func(i int) bool {
+		return li.layers[i].StartLine > n
+	}) - 1
+}
+
+// Layer returns the layer of line n, ok is false if the line is before the first layer
+func (li *LayerIndex) Layer(n int) (l Layer, ok bool) {
+	if i := li.At(n); i >= 0 {
+		return li.layers[i], true
+	}
+	return l, false
+}
@@ -0,0 +1,149 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type Material struct {
+	Density        float64 // g/cm3
+	StandbyTemp    float64 // °C of idle nozzles
+	MinExtrudeTemp float64 // °C
+	BedTemp        float64 // °C
+}
+
+// DeepFreezeTemp is far below the extrude temperature, for a nozzle idle for a long time
+func (m Material) DeepFreezeTemp() float64 {
+	return m.MinExtrudeTemp - 70
+}
+
+// MaterialTable is keyed by the prefix of filament_type, e.g. PETG-CF is PETG-CF, PETG-HF is PETG, PCTG is unknown
+type MaterialTable map[string]Material
+
+var Materials = MaterialTable{
+	"PLA":     {Density: 1.24, StandbyTemp: 150, MinExtrudeTemp: 180, BedTemp: 60},
+	"PLA-CF":  {Density: 1.30, StandbyTemp: 150, MinExtrudeTemp: 200, BedTemp: 60},
+	"PETG":    {Density: 1.27, StandbyTemp: 170, MinExtrudeTemp: 220, BedTemp: 75},
+	"PETG-CF": {Density: 1.30, StandbyTemp: 170, MinExtrudeTemp: 230, BedTemp: 75},
+	"PET":     {Density: 1.38, StandbyTemp: 170, MinExtrudeTemp: 220, BedTemp: 75},
+	"ABS":     {Density: 1.04, StandbyTemp: 180, MinExtrudeTemp: 230, BedTemp: 100},
+	"ABS-CF":  {Density: 1.10, StandbyTemp: 180, MinExtrudeTemp: 240, BedTemp: 100},
+	"ASA":     {Density: 1.07, StandbyTemp: 180, MinExtrudeTemp: 235, BedTemp: 100},
+	"ASA-CF":  {Density: 1.12, StandbyTemp: 180, MinExtrudeTemp: 245, BedTemp: 100},
+	"TPU":     {Density: 1.21, StandbyTemp: 160, MinExtrudeTemp: 200, BedTemp: 40},
+	"PA":      {Density: 1.14, StandbyTemp: 200, MinExtrudeTemp: 250, BedTemp: 80},
+	"PA-CF":   {Density: 1.20, StandbyTemp: 200, MinExtrudeTemp: 260, BedTemp: 80},
+	"PC":      {Density: 1.20, StandbyTemp: 210, MinExtrudeTemp: 260, BedTemp: 110},
+	"PC-CF":   {Density: 1.25, StandbyTemp: 210, MinExtrudeTemp: 270, BedTemp: 110},
+	"PVA":     {Density: 1.23, StandbyTemp: 140, MinExtrudeTemp: 185, BedTemp: 60},
+	"HIPS":    {Density: 1.04, StandbyTemp: 180, MinExtrudeTemp: 220, BedTemp: 100},
+}
+
+// DefaultMaterial is used when the filament type is unknown
+var DefaultMaterial = Materials["PLA"]
+
+// Lookup finds the material by the longest key which is prefix of the filament type, see lookupMaterial
+func (t MaterialTable) Lookup(filamentType string) (Material, bool) {
+	return lookupMaterial(t, filamentType)
+}
+
+// LookupOrDefault returns DefaultMaterial if the filament type is unknown
+func (t MaterialTable) LookupOrDefault(filamentType string) Material {
+	if m, ok := t.Lookup(filamentType); ok {
+		return m
+	}
+	return DefaultMaterial
+}
+
+// Override applies options like "material.PETG.standby_temp = 175",
+// fields are density, standby_temp, min_extrude_temp and bed_temp, unknown materials are added.
+func (t MaterialTable) Override(opts Options) error {
+	for key := range opts {
+		if !strings.HasPrefix(key, "material.") {
+			continue
+		}
+		parts := strings.Split(key, ".")
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("invalid option %q, want material.<NAME>.<FIELD>", key)
+		}
+		name, field := strings.ToUpper(parts[1]), parts[2]
+		v, err := strconv.ParseFloat(opts.Str(key, ""), 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		m, ok := t[name]
+		if !ok {
+			m = DefaultMaterial
+		}
+		switch field {
+		case "density":
+			m.Density = v
+		case "standby_temp":
+			m.StandbyTemp = v
+		case "min_extrude_temp":
+			m.MinExtrudeTemp = v
+		case "bed_temp":
+			m.BedTemp = v
+		default:
+			return fmt.Errorf("unknown field of material: %q", key)
+		}
+		t[name] = m
+	}
+	return nil
+}
+
+// isLetter reports if c is an ASCII letter, the name of a material ends before any other byte
+func isLetter(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// lookupMaterial finds the longest key which is prefix of the filament type and ends at a word,
+// e.g. PA12 and PLA+ are PA and PLA, PCTG is not PC
+func lookupMaterial[T any](table map[string]T, filamentType string) (v T, ok bool) {
+	typ := strings.ToUpper(strings.TrimSpace(filamentType))
+	matched := ""
+	for k := range table {
+		if !strings.HasPrefix(typ, k) || len(typ) > len(k) && isLetter(typ[len(k)]) {
+			continue
+		}
+		if len(k) > len(matched) {
+			matched = k
+		}
+	}
+	if matched == "" {
+		return v, false
+	}
+	return table[matched], true
+}
+
+// FilamentWeight in grams of length mm
+func FilamentWeight(length, diameter, density float64) float64 {
+	r := diameter / 2
+	return length * math.Pi * r * r / 1000 * density
+}
+
+// checkColdExtrusion warns about extrusions of a tool below the min extrude temperature of its material
+func checkColdExtrusion(ctx *Context, gcodes []*GcodeBlock) {
+	state := NewMachineState()
+	warned := map[int32]bool{}
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+
+		tool := state.Tool
+		if tool < 0 || tool >= MaxTools || warned[tool] || !isExtruding(g, state.E, prev.E) {
+			continue
+		}
+		temp := state.Temps[tool]
+		if temp <= 0 || int(tool) >= len(ctx.Params.FilamentTypes) {
+			continue // unknown
+		}
+		if m, ok := Materials.Lookup(ctx.Params.FilamentTypes[tool]); ok && temp < m.MinExtrudeTemp {
+			ctx.Warnf("line %d: T%d extrudes %s at %g°C, below %g°C", n+1, tool, ctx.Params.FilamentTypes[tool], temp, m.MinExtrudeTemp)
+			warned[tool] = true
+		}
+	}
+}
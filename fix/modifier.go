@@ -0,0 +1,338 @@
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Modifier is a step of the fix pipeline.
+// Unlike GcodeModifier, it can see the parsed params and options through ctx and report errors.
+type Modifier interface {
+	Name() string
+	Apply(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error)
+}
+
+type ModifierFunc func(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error)
+
+type namedModifier struct {
+	name string
+	fn   ModifierFunc
+}
+
+func (m *namedModifier) Name() string {
+	return m.name
+}
+
+func (m *namedModifier) Apply(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	return m.fn(ctx, gcodes)
+}
+
+// NewModifier returns a Modifier named name that calls fn
+func NewModifier(name string, fn ModifierFunc) Modifier {
+	return &namedModifier{name: name, fn: fn}
+}
+
+// Adapt wraps an old-style GcodeModifier, it never fails
+func Adapt(name string, fn GcodeModifier) Modifier {
+	return NewModifier(name, func(_ *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+		return fn(gcodes), nil
+	})
+}
+
+var (
+	modifiersMu sync.RWMutex
+	modifiers   = map[string]Modifier{}
+)
+
+// RegisterModifier makes a modifier available by its name
+func RegisterModifier(m Modifier) error {
+	modifiersMu.Lock()
+	defer modifiersMu.Unlock()
+	if _, ok := modifiers[m.Name()]; ok {
+		return fmt.Errorf("modifier %q already registered", m.Name())
+	}
+	modifiers[m.Name()] = m
+	return nil
+}
+
+func LookupModifier(name string) (Modifier, bool) {
+	modifiersMu.RLock()
+	defer modifiersMu.RUnlock()
+	m, ok := modifiers[name]
+	return m, ok
+}
+
+// Pipeline runs modifiers in order, stops at the first error
+type Pipeline []Modifier
+
+func (p Pipeline) Run(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	for _, m := range p {
+		ctx.modifier = m.Name()
+		output, err := m.Apply(ctx, gcodes)
+		if err != nil {
+			ctx.modifier = ""
+			return gcodes, fmt.Errorf("%s: %w", m.Name(), err)
+		}
+		gcodes = output
+	}
+	ctx.modifier = ""
+	return gcodes, nil
+}
+
+// NewPipeline looks up the modifiers by names
+func NewPipeline(names ...string) (Pipeline, error) {
+	p := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		m, ok := LookupModifier(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier %q", name)
+		}
+		p = append(p, m)
+	}
+	return p, nil
+}
+
+// Context is shared by all modifiers of a pipeline
+type Context struct {
+	Params  *slicerParams
+	Options Options
+	Logger  *log.Logger
+	Changes *ChangeRecorder
+
+	modifier string // name of the running modifier
+}
+
+func NewContext(params *slicerParams, opts Options) *Context {
+	if params == nil {
+		params = NewParams()
+	}
+	if opts == nil {
+		opts = Options{}
+	}
+	return &Context{
+		Params:  params,
+		Options: opts,
+		Logger:  log.New(io.Discard, "", 0),
+		Changes: &ChangeRecorder{},
+	}
+}
+
+// Record a change made by the running modifier at line n of its input
+func (ctx *Context) Record(n int, format string, args ...any) {
+	ctx.Changes.Record(Change{
+		Modifier: ctx.modifier,
+		Line:     n,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Note records a change which is listed in the summary
+func (ctx *Context) Note(n int, format string, args ...any) {
+	ctx.Changes.Record(Change{
+		Modifier: ctx.modifier,
+		Line:     n,
+		Message:  fmt.Sprintf(format, args...),
+		Notable:  true,
+	})
+}
+
+func (ctx *Context) Logf(format string, args ...any) {
+	if ctx.modifier != "" {
+		format = "[" + ctx.modifier + "] " + format
+	}
+	ctx.Logger.Printf(format, args...)
+}
+
+func (ctx *Context) Warnf(format string, args ...any) {
+	ctx.Logf("warning: "+format, args...)
+}
+
+type Change struct {
+	Modifier string
+	Line     int // index of the line in the input of the modifier
+	Message  string
+	Notable  bool // listed in the summary
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("[%s] line %d: %s", c.Modifier, c.Line+1, c.Message)
+}
+
+// ChangeRecorder collects changes, it is safe for concurrent use
+type ChangeRecorder struct {
+	mu      sync.Mutex
+	changes []Change
+}
+
+func (r *ChangeRecorder) Record(c Change) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.changes = append(r.changes, c)
+	r.mu.Unlock()
+}
+
+func (r *ChangeRecorder) Changes() []Change {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := make([]Change, len(r.changes))
+	copy(changes, r.changes)
+	return changes
+}
+
+// Count returns number of changes made by the modifier, or by all if name is empty
+func (r *ChangeRecorder) Count(name string) (n int) {
+	for _, c := range r.Changes() {
+		if name == "" || c.Modifier == name {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary returns one line per modifier, e.g. "shutoff: 2 changes", followed by the notable changes
+func (r *ChangeRecorder) Summary() []string {
+	var (
+		counts  = map[string]int{}
+		notable = map[string][]Change{}
+	)
+	for _, c := range r.Changes() {
+		counts[c.Modifier]++
+		if c.Notable {
+			notable[c.Modifier] = append(notable[c.Modifier], c)
+		}
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %d changes", name, counts[name]))
+		for _, c := range notable[name] {
+			lines = append(lines, fmt.Sprintf("  line %d: %s", c.Line+1, c.Message))
+		}
+	}
+	return lines
+}
+
+// Options holds the settings of modifiers as key/values, e.g. "preheat.long=3".
+// A key may be set more than once, getters use the last value.
+type Options map[string][]string
+
+// Parse parses "key=value" and adds it
+func (o Options) Parse(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("invalid option %q, want key=value", s)
+	}
+	o.Add(s[:i], s[i+1:])
+	return nil
+}
+
+/*
+Load reads options from a config file, one "key = value" per line, e.g.
+
+	# comments start with #
+	preheat.long = 3
+	rule = M106 S* -> S = min(S, 200)
+*/
+func (o Options) Load(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := o.Parse(line); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+func (o Options) Add(key, value string) {
+	key = strings.TrimSpace(key)
+	o[key] = append(o[key], strings.TrimSpace(value))
+}
+
+func (o Options) Has(key string) bool {
+	return len(o[key]) > 0
+}
+
+func (o Options) Values(key string) []string {
+	return o[key]
+}
+
+func (o Options) Get(key string) (string, bool) {
+	if vs := o[key]; len(vs) > 0 {
+		return vs[len(vs)-1], true
+	}
+	return "", false
+}
+
+func (o Options) Str(key, def string) string {
+	if v, ok := o.Get(key); ok {
+		return v
+	}
+	return def
+}
+
+// Float returns def if the key is missing or not a number
+func (o Options) Float(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(o.Str(key, ""), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func (o Options) Int(key string, def int) int {
+	if v, err := strconv.Atoi(o.Str(key, "")); err == nil {
+		return v
+	}
+	return def
+}
+
+func (o Options) Bool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(o.Str(key, "")); err == nil {
+		return v
+	}
+	return def
+}
+
+func init() {
+	for _, m := range []Modifier{
+		NewModifier("idex", convertIdexMode),
+		NewModifier("shutoff", fixShutoff),
+		NewModifier("standby", fixStandby),
+		NewModifier("preheat", fixPreheat),
+		NewModifier("replacetool", replaceToolNum),
+		NewModifier("colorchange", changeColors),
+		NewModifier("toolchange", rewriteToolChanges),
+		NewModifier("fans", normalizeFans),
+		NewModifier("reinforcetower", reinforceTower),
+		NewModifier("orcatoolunload", fixOrcaToolUnload),
+		NewModifier("inject", injectCommands),
+		NewModifier("arcfit", fitArcs),
+		NewModifier("arcexpand", expandArcs),
+		NewModifier("rules", applyRules),
+		NewModifier("optimize", optimize),
+		NewModifier("checksum", renumberLines),
+	} {
+		if err := RegisterModifier(m); err != nil {
+			panic(err)
+		}
+	}
+}
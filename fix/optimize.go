@@ -0,0 +1,329 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// rules of optimize, each one is turned off by "optimize.<rule>=false"
+const (
+	OptimizeDwell     = "dwell"      // G4 S0 and G4 P0
+	OptimizeFeedrate  = "feedrate"   // F of the current feedrate
+	OptimizeZeroMoves = "zero_moves" // moves to the current position
+	OptimizeSettings  = "settings"   // M104/M140/M106/M107 of the current value
+	OptimizeTravels   = "travels"    // travels on a line, to the end of the line
+	OptimizeComments  = "comments"   // empty comments
+)
+
+var OptimizeRules = []string{OptimizeDwell, OptimizeFeedrate, OptimizeZeroMoves, OptimizeSettings, OptimizeTravels, OptimizeComments}
+
+// optimizeStats is the saving of a rule
+type optimizeStats struct {
+	Lines, Bytes int
+}
+
+// optimizer knows what the printer has been told, the values are unknown until they are set by the gcodes
+type optimizer struct {
+	rules map[string]bool
+	stats map[string]*optimizeStats
+
+	state    MachineState
+	axes     map[byte]bool   // positions which are known
+	feedrate bool            // F is known
+	settings map[string]bool // e.g. "M104 T0", "M140", "M106 P1"
+}
+
+func newOptimizer(ctx *Context) *optimizer {
+	o := &optimizer{
+		rules:    map[string]bool{},
+		stats:    map[string]*optimizeStats{},
+		state:    NewMachineState(),
+		axes:     map[byte]bool{},
+		settings: map[string]bool{},
+	}
+	for _, r := range OptimizeRules {
+		o.rules[r] = ctx.Options.Bool("optimize."+r, true)
+		o.stats[r] = &optimizeStats{}
+	}
+	return o
+}
+
+func (o *optimizer) save(rule string, lines int, before, after string) {
+	o.stats[rule].Lines += lines
+	o.stats[rule].Bytes += len(before) - len(after)
+	if lines > 0 {
+		o.stats[rule].Bytes++ // the newline
+	}
+}
+
+// isMove reports if g is G0/G1 with X/Y/Z/E/F only
+func isMove(g *GcodeBlock) bool {
+	if !g.Is("G0") && !g.Is("G1") {
+		return false
+	}
+	for _, p := range g.Params() {
+		switch p.Word() {
+		case 'X', 'Y', 'Z', 'E', 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isZeroMove reports if the move g goes nowhere from the state, F is checked by the caller
+func (o *optimizer) isZeroMove(g *GcodeBlock) bool {
+	for _, w := range []byte{'X', 'Y', 'Z', 'E'} {
+		v, ok := g.paramFloat(w)
+		if !g.HasParam(w) {
+			continue
+		}
+		relative := o.state.Relative
+		if w == 'E' {
+			relative = o.state.RelativeE
+		}
+		switch {
+		case !ok:
+			return false
+		case relative:
+			if v != 0 {
+				return false
+			}
+		case !o.axes[w] || v != o.position(w):
+			return false
+		}
+	}
+	return true
+}
+
+func (o *optimizer) position(w byte) float64 {
+	if w == 'E' {
+		return o.state.E
+	}
+	return axisOf(o.state, w)
+}
+
+// setting returns the key and the value of M104/M140/M106/M107 which can be dropped, ok is false for other lines
+func (o *optimizer) setting(g *GcodeBlock) (key string, v float64, ok bool) {
+	only := func(words string) bool {
+		for _, p := range g.Params() {
+			if !strings.ContainsRune(words, rune(p.Word())) {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case g.Is("M104") && only("ST"):
+		v, ok = g.paramFloat('S')
+		return fmt.Sprintf("M104 T%d", o.state.toolOf(g)), v, ok && o.state.toolOf(g) >= 0
+	case g.Is("M140") && only("S"):
+		v, ok = g.paramFloat('S')
+		return "M140", v, ok
+	case g.Is("M106") && only("SP"):
+		v, ok = 255, true
+		if g.HasParam('S') {
+			v, ok = g.paramFloat('S')
+		}
+		p, _ := g.paramFloat('P')
+		return fmt.Sprintf("M106 P%d", int(p)), v, ok
+	case g.Is("M107") && only("P"):
+		p, _ := g.paramFloat('P')
+		return fmt.Sprintf("M106 P%d", int(p)), 0, true
+	}
+	return "", 0, false
+}
+
+// current returns the value of the setting in the state
+func (o *optimizer) current(g *GcodeBlock) float64 {
+	switch {
+	case g.Is("M104"):
+		if t := o.state.toolOf(g); t >= 0 && t < MaxTools {
+			return o.state.Temps[t]
+		}
+	case g.Is("M140"):
+		return o.state.BedTemp
+	case g.Is("M106"), g.Is("M107"):
+		p, _ := g.paramFloat('P')
+		if p >= 0 && int(p) < MaxTools {
+			return o.state.Fans[int(p)]
+		}
+	}
+	return math.NaN()
+}
+
+// learn updates what the printer knows after the line
+func (o *optimizer) learn(g *GcodeBlock) {
+	switch {
+	case g.Is("G0"), g.Is("G1"), g.Is("G2"), g.Is("G3"), g.Is("G92"):
+		for _, p := range g.Params() {
+			switch w := p.Word(); w {
+			case 'X', 'Y', 'Z', 'E':
+				relative := o.state.Relative
+				if w == 'E' {
+					relative = o.state.RelativeE
+				}
+				if g.Is("G92") || !relative {
+					o.axes[w] = true
+				}
+			case 'F':
+				o.feedrate = true
+			}
+		}
+		if g.Is("G92") && len(g.Params()) == 0 {
+			o.axes['X'], o.axes['Y'], o.axes['Z'], o.axes['E'] = true, true, true, true
+		}
+		if g.Is("G2") || g.Is("G3") {
+			o.axes['X'], o.axes['Y'] = true, true // ends at X/Y which are known or given
+		}
+	case g.Is("G28"):
+		homed := false
+		for _, w := range []byte{'X', 'Y', 'Z'} {
+			if g.HasParam(w) {
+				o.axes[w], homed = true, true
+			}
+		}
+		if !homed {
+			o.axes['X'], o.axes['Y'], o.axes['Z'] = true, true, true
+		}
+	case g.Is("M109"), g.Is("M190"):
+		key := "M140"
+		if g.Is("M109") {
+			key = fmt.Sprintf("M104 T%d", o.state.toolOf(g))
+		}
+		// M109 R waits for cooling too, the temperature is not in the state
+		o.settings[key] = g.HasParam('S') && !g.HasParam('R')
+	default:
+		if key, _, ok := o.setting(g); ok {
+			o.settings[key] = true
+		} else if g.Is("M104") || g.Is("M140") || g.Is("M106") || g.Is("M107") {
+			o.settings = map[string]bool{} // unknown forms, e.g. M104 with autotemp
+		}
+	}
+	o.state.Update(g)
+}
+
+// travel is the last line of output if it is a travel, from the position before it
+type travel struct {
+	at   int // in output, -1 if the last line is not a travel
+	from MachineState
+}
+
+// isTravel reports if g is an absolute move without E and comment
+func (o *optimizer) isTravel(g *GcodeBlock) bool {
+	return isMove(g) && !g.HasParam('E') && g.Comment() == "" && !o.state.Relative &&
+		(g.HasParam('X') || g.HasParam('Y') || g.HasParam('Z'))
+}
+
+// onLine reports if b is between a and c, on the line from a to c
+func onLine(a, b, c MachineState) bool {
+	dist := func(p, q MachineState) float64 {
+		return math.Sqrt((p.X-q.X)*(p.X-q.X) + (p.Y-q.Y)*(p.Y-q.Y) + (p.Z-q.Z)*(p.Z-q.Z))
+	}
+	ab, bc := dist(a, b), dist(b, c)
+	return ab > 0 && bc > 0 && ab+bc-dist(a, c) < 1e-4
+}
+
+/*
+optimize removes the commands which change nothing, by the rules (all on by default, "optimize.<rule>=false" turns one off):
+
+  - dwell:      G4 S0 and G4 P0
+  - feedrate:   F of the moves which is the current feedrate
+  - zero_moves: moves to the current position
+  - settings:   M104/M140/M106/M107 which set the current temperature or fan speed
+  - travels:    travels on a line are merged into one travel to the end of the line
+  - comments:   empty comments, e.g. ";"
+
+A value is current only if the gcodes have set it, the position before homing or the temperature before
+the first M104 is unknown, so the first commands are always kept. The lines and bytes saved by each rule are logged.
+*/
+func optimize(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	var (
+		o      = newOptimizer(ctx)
+		output = make([]*GcodeBlock, 0, len(gcodes))
+		last   = travel{at: -1}
+	)
+	for n, g := range gcodes {
+		before := g.String()
+
+		if o.rules[OptimizeComments] && g.Comment() != "" && strings.TrimSpace(strings.TrimLeft(g.Comment(), ";")) == "" {
+			if g.IsComment() {
+				o.save(OptimizeComments, 1, before, "")
+				ctx.Record(n, "empty comment")
+				continue
+			}
+			g = g.Copy()
+			g.SetComment("")
+			o.save(OptimizeComments, 0, before, g.String())
+			before = g.String()
+		}
+
+		if o.rules[OptimizeDwell] && g.Is("G4") && len(g.Params()) == 1 {
+			if v, ok := g.paramFloat(g.Params()[0].Word()); ok && v == 0 && g.Comment() == "" {
+				o.save(OptimizeDwell, 1, before, "")
+				ctx.Record(n, "%s", before)
+				continue
+			}
+		}
+
+		if o.rules[OptimizeSettings] {
+			if key, v, ok := o.setting(g); ok && o.settings[key] && v == o.current(g) && g.Comment() == "" {
+				o.save(OptimizeSettings, 1, before, "")
+				ctx.Record(n, "%s", before)
+				continue
+			}
+		}
+
+		if isMove(g) {
+			f, hasF := g.paramFloat('F')
+			sameF := !g.HasParam('F') || (hasF && o.feedrate && f == o.state.F)
+			if o.rules[OptimizeZeroMoves] && sameF && o.isZeroMove(g) && g.Comment() == "" {
+				o.learn(g)
+				o.save(OptimizeZeroMoves, 1, before, "")
+				ctx.Record(n, "%s", before)
+				continue
+			}
+			if o.rules[OptimizeFeedrate] && g.HasParam('F') && sameF && len(g.Params()) > 1 {
+				g = g.Copy()
+				g.RemoveParam('F')
+				o.save(OptimizeFeedrate, 0, before, g.String())
+				before = g.String()
+			}
+		}
+
+		from := o.state
+		if o.rules[OptimizeTravels] && o.isTravel(g) {
+			o.learn(g)
+			if last.at >= 0 && last.at == len(output)-1 && o.state.F == from.F && onLine(last.from, from, o.state) {
+				merged := g.Copy()
+				if f, ok := output[last.at].paramFloat('F'); ok && !merged.HasParam('F') {
+					merged.SetParam('F', strconv.FormatFloat(f, 'f', -1, 64))
+				}
+				o.save(OptimizeTravels, 1, output[last.at].String()+before, merged.String())
+				ctx.Record(n, "travel merged with the line before")
+				output[last.at] = merged
+				continue
+			}
+			last = travel{at: len(output), from: from}
+			output = append(output, g)
+			continue
+		}
+
+		o.learn(g)
+		output = append(output, g)
+	}
+
+	var lines, bytes int
+	for _, r := range OptimizeRules {
+		if s := o.stats[r]; s.Lines > 0 || s.Bytes > 0 {
+			ctx.Logf("%s: %d lines, %d bytes", r, s.Lines, s.Bytes)
+			lines, bytes = lines+s.Lines, bytes+s.Bytes
+		}
+	}
+	if bytes > 0 {
+		ctx.Logf("%d lines, %d bytes smaller", lines, bytes)
+	}
+	return output, nil
+}
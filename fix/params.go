@@ -2,6 +2,7 @@ package fix
 
 import (
 	"errors"
+	"math"
 	"strings"
 )
 
@@ -28,8 +29,11 @@ type slicerParams struct {
 	SwitchRetraction   []float64
 	BedTemperatures    []float64
 	FilamentTypes      []string
+	SlicerFilaments    []string  // filament_type of the slicer, includes the unused extruders
 	FilamentUsed       []float64 // mm
-	FilamentUsedWeight []float64 // len * 1.24g/cm3 * pi * 1.75/2 * 1.75/2
+	FilamentUsedWeight []float64 // g, by the density of Materials if the slicer does not tell
+	FilamentDiameters  []float64 // mm
+	ColorSequence      []string  // filaments of the single nozzle in the order of printing, see changeColors
 	PrintSpeedSec      float64   // ;work_speed
 	MinX               float64
 	MinY               float64
@@ -56,6 +60,11 @@ func (p *slicerParams) AllFilamentUsedWeight() float64 {
 	return p.FilamentUsedWeight[0] + p.FilamentUsedWeight[1]
 }
 
+// SingleNozzle reports if all tools are printed by one nozzle
+func (p *slicerParams) SingleNozzle() bool {
+	return p.ToolHead == ToolheadSingle && p.Model != ModelJ1
+}
+
 func (p *slicerParams) effective(x, y float64) float64 {
 	if x < 1 {
 		return y
@@ -82,8 +91,10 @@ func NewParams() *slicerParams {
 		SwitchRetraction:   []float64{-1, -1},
 		BedTemperatures:    []float64{-1, -1},
 		FilamentTypes:      []string{"", ""},
+		SlicerFilaments:    []string{"", ""},
 		FilamentUsed:       []float64{-1, -1},
 		FilamentUsedWeight: []float64{-1, -1},
+		FilamentDiameters:  []float64{1.75, 1.75},
 		PrintSpeedSec:      0,
 		MinX:               0,
 		MinY:               0,
@@ -133,6 +144,10 @@ func ParseParams(gcodes []*GcodeBlock) error {
 			Params.PrintMode = PrintModeMirror
 		} else if strings.HasPrefix(line, "M605 S4") {
 			Params.PrintMode = PrintModeBackup
+		} else if strings.HasPrefix(line, ";(Fixed: color ") {
+			if i := strings.LastIndex(line, ": "); i > 0 {
+				Params.ColorSequence = append(Params.ColorSequence, strings.TrimSuffix(line[i+2:], ")"))
+			}
 		} else if strings.HasPrefix(line, "; thumbnail begin ") {
 			thumbnail_start = true
 		} else if strings.HasPrefix(line, "; thumbnail end") {
@@ -146,6 +161,7 @@ func ParseParams(gcodes []*GcodeBlock) error {
 			Params.EstimatedTimeSec = convertEstimatedTime(v)
 		} else if v, ok := getSetting(line, "filament_type"); ok {
 			Params.FilamentTypes = split(v)
+			Params.SlicerFilaments = split(v)
 		} else if v, ok := getSetting(line, "total_layer_number", "total layers count" /* bbs*/); ok {
 			if layers, err := ParseInt([]byte(v)); err == nil { // ignore errors
 				Params.TotalLayers = int(layers)
@@ -156,6 +172,8 @@ func ParseParams(gcodes []*GcodeBlock) error {
 			retract_len = splitFloat(v)
 		} else if v, ok := getSetting(line, "retract_length_toolchange"); ok {
 			Params.SwitchRetraction = splitFloat(v)
+		} else if v, ok := getSetting(line, "filament_diameter"); ok {
+			Params.FilamentDiameters = splitFloat(v)
 		} else if v, ok := getSetting(line, "nozzle_diameter"); ok {
 			Params.NozzleDiameters = splitFloat(v)
 		} else if v, ok := getSetting(line, "layer_height", "first_layer_height"); ok && Params.LayerHeight == 0 {
@@ -194,6 +212,10 @@ func ParseParams(gcodes []*GcodeBlock) error {
 	}
 
 	//////// process params
+	if Params.TotalLayers == 0 {
+		Params.TotalLayers = DetectLayers(gcodes).Len()
+	}
+
 	if len(thumbnail_bytes) > 0 {
 		Params.Thumbnail = convertThumbnail(thumbnail_bytes)
 	}
@@ -227,8 +249,44 @@ func ParseParams(gcodes []*GcodeBlock) error {
 		Params.Retractions[1] = 0
 	}
 
+	// both heads print the material of T0 in IDEX modes
+	if Params.PrintMode != PrintModeDefault && Params.LeftExtruderUsed && !Params.RightExtruderUsed {
+		Params.RightExtruderUsed = true
+		Params.FilamentTypes[1] = Params.FilamentTypes[0]
+		Params.NozzleTemperatures[1] = Params.NozzleTemperatures[0]
+		Params.NozzleDiameters[1] = Params.NozzleDiameters[0]
+		Params.BedTemperatures[1] = Params.BedTemperatures[0]
+		Params.Retractions[1] = Params.Retractions[0]
+		Params.SwitchRetraction[1] = Params.SwitchRetraction[0]
+		Params.FilamentDiameters[1] = Params.FilamentDiameters[0]
+		if Params.PrintMode != PrintModeBackup {
+			// T1 prints a copy, but takes over in backup mode
+			Params.FilamentUsed[1] = Params.FilamentUsed[0]
+			Params.FilamentUsedWeight[1] = Params.FilamentUsedWeight[0]
+		}
+	}
+
+	// fill the missing by materials
+	for i, used := range []bool{Params.LeftExtruderUsed, Params.RightExtruderUsed} {
+		if !used {
+			continue
+		}
+		m := Materials.LookupOrDefault(Params.FilamentTypes[i])
+		if Params.FilamentUsedWeight[i] <= 0 && Params.FilamentUsed[i] > 0 {
+			d := Params.FilamentDiameters[i]
+			if d <= 0 {
+				d = 1.75
+			}
+			Params.FilamentUsedWeight[i] = math.Round(FilamentWeight(Params.FilamentUsed[i], d, m.Density)*100) / 100
+		}
+		if Params.BedTemperatures[i] < 0 {
+			Params.BedTemperatures[i] = m.BedTemp
+		}
+	}
+
 	{
-		if Params.LeftExtruderUsed && Params.RightExtruderUsed {
+		// a single nozzle has one nozzle_diameter, even if it prints the filaments of many tools
+		if Params.LeftExtruderUsed && Params.RightExtruderUsed && Params.NozzleDiameters[1] != 0 {
 			Params.ToolHead = ToolheadDual
 		}
 
@@ -240,7 +298,7 @@ func ParseParams(gcodes []*GcodeBlock) error {
 
 	}
 
-	if Params.PrintMode == PrintModeMirror || Params.PrintMode == PrintModeDuplication {
+	if Params.PrintMode == PrintModeMirror || Params.PrintMode == PrintModeDuplication || Params.PrintMode == PrintModeBackup {
 		// is IDEX
 		Params.Version = 1
 		Params.Model = ModelJ1
@@ -0,0 +1,303 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+Plugin runs an external command as a modifier.
+
+The gcodes are written to stdin of the command and the modified gcodes are read back from stdout,
+one block per line. Lines written to stderr are forwarded to the logger.
+
+There are two formats:
+
+	text: the G-code lines as they would be written to the output file
+	json: one GcodeBlock per line, e.g. {"cmd":"G1","params":["X10.5","E0.2"],"comment":"; move"},
+	      {"cmd":"M117","text":"Hello world"}, and "n"/"checksum" for the lines with N
+
+The command is started with these environment variables:
+
+	SMFIX_PLUGIN_PROTOCOL  protocol version, currently 1
+	SMFIX_PLUGIN_FORMAT    text or json
+	SMFIX_PARAMS           the parsed params as a json object, see PluginParams
+
+A Plugin is a Modifier named by its name, it can be registered by RegisterModifier to be placed in the pipeline by name.
+*/
+type Plugin struct {
+	Command string
+	Args    []string
+	Format  string
+	Timeout time.Duration
+
+	name string
+}
+
+const (
+	PluginProtocolVersion = 1
+
+	PluginFormatText = "text"
+	PluginFormatJSON = "json"
+
+	PluginDefaultTimeout = 60 * time.Second
+	PluginWaitDelay      = time.Second // for the output after the command exits or times out
+)
+
+var ErrPluginTimeout = errors.New("plugin timed out")
+
+// NewPlugin parses the command line of plugin, arguments are separated by spaces
+func NewPlugin(name, command string) (*Plugin, error) {
+	args := strings.Fields(command)
+	if name == "" || len(args) == 0 {
+		return nil, fmt.Errorf("invalid plugin %q: %q", name, command)
+	}
+	return &Plugin{
+		Command: args[0],
+		Args:    args[1:],
+		Format:  PluginFormatText,
+		Timeout: PluginDefaultTimeout,
+		name:    name,
+	}, nil
+}
+
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// Apply runs the command, "plugin.<name>.format" and "plugin.<name>.timeout" options overwrite the fields
+func (p *Plugin) Apply(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	format := ctx.Options.Str("plugin."+p.name+".format", p.Format)
+	if format != PluginFormatText && format != PluginFormatJSON {
+		return nil, fmt.Errorf("unsupported plugin format %q", format)
+	}
+	timeout := p.Timeout
+	if v, ok := ctx.Options.Get("plugin." + p.name + ".timeout"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+		timeout = d
+	}
+
+	params, err := json.Marshal(newPluginParams(ctx.Params))
+	if err != nil {
+		return nil, err
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(c, p.Command, p.Args...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SMFIX_PLUGIN_PROTOCOL=%d", PluginProtocolVersion),
+		"SMFIX_PLUGIN_FORMAT="+format,
+		"SMFIX_PARAMS="+string(params),
+	)
+
+	// closes the pipes if the command or a process started by it keeps them open after it exits
+	cmd.WaitDelay = PluginWaitDelay
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, w := io.Pipe()
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writePluginInput(stdin, format, gcodes)
+	}()
+
+	var (
+		output  []*GcodeBlock
+		readErr error
+		read    = make(chan struct{})
+	)
+	go func() {
+		output, readErr = readPluginOutput(stdout, format, len(gcodes))
+		close(read)
+	}()
+	waitErr := cmd.Wait()
+	w.Close()
+	<-read
+
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" {
+			ctx.Logf("%s", line)
+		}
+	}
+
+	// the output of a command which exits in time is kept, even if the deadline has passed since
+	switch {
+	case (waitErr != nil || readErr != nil) && c.Err() == context.DeadlineExceeded:
+		return nil, fmt.Errorf("%w after %s", ErrPluginTimeout, timeout)
+	case waitErr != nil:
+		return nil, fmt.Errorf("%s: %w", p.Command, waitErr)
+	case readErr != nil:
+		return nil, readErr
+	}
+	if err := <-writeErr; err != nil && !errors.Is(err, os.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		return nil, err
+	}
+
+	if d := len(output) - len(gcodes); d != 0 {
+		ctx.Record(0, "%+d lines", d)
+	}
+	return output, nil
+}
+
+func writePluginInput(w io.WriteCloser, format string, gcodes []*GcodeBlock) error {
+	defer w.Close()
+	bw := bufio.NewWriterSize(w, 64*1024)
+	enc := json.NewEncoder(bw)
+	for _, gcode := range gcodes {
+		var err error
+		if format == PluginFormatJSON {
+			err = enc.Encode(gcode)
+		} else {
+			_, err = bw.WriteString(gcode.String() + "\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func readPluginOutput(r io.Reader, format string, sizeHint int) ([]*GcodeBlock, error) {
+	output := make([]*GcodeBlock, 0, sizeHint)
+	rd := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if s := strings.TrimRight(line, "\r\n"); s != "" {
+			var (
+				g       *GcodeBlock
+				lineErr error
+			)
+			if format == PluginFormatJSON {
+				g = &GcodeBlock{}
+				lineErr = json.Unmarshal([]byte(s), g)
+			} else {
+				g, lineErr = ParseGcodeBlock(s)
+			}
+			if lineErr != nil && lineErr != ErrEmptyString {
+				io.Copy(io.Discard, rd)
+				return nil, fmt.Errorf("plugin output line %d: %w", n, lineErr)
+			}
+			if lineErr == nil {
+				output = append(output, g)
+			}
+		}
+		if err == io.EOF {
+			return output, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// PluginParams is the subset of params passed to plugins by SMFIX_PARAMS
+type PluginParams struct {
+	Version            int       `json:"version"`
+	Model              string    `json:"model"`
+	ToolHead           string    `json:"tool_head"`
+	PrintMode          string    `json:"print_mode"`
+	LayerHeight        float64   `json:"layer_height"`
+	TotalLayers        int       `json:"total_layers"`
+	NozzleTemperatures []float64 `json:"nozzle_temperatures"`
+	NozzleDiameters    []float64 `json:"nozzle_diameters"`
+	BedTemperatures    []float64 `json:"bed_temperatures"`
+	FilamentTypes      []string  `json:"filament_types"`
+}
+
+func newPluginParams(p *slicerParams) PluginParams {
+	return PluginParams{
+		Version:            p.Version,
+		Model:              p.Model,
+		ToolHead:           p.ToolHead,
+		PrintMode:          p.PrintMode,
+		LayerHeight:        p.LayerHeight,
+		TotalLayers:        p.TotalLayers,
+		NozzleTemperatures: p.NozzleTemperatures,
+		NozzleDiameters:    p.NozzleDiameters,
+		BedTemperatures:    p.BedTemperatures,
+		FilamentTypes:      p.FilamentTypes,
+	}
+}
+
+type jsonGcodeBlock struct {
+	N        *int64   `json:"n,omitempty"`
+	Cmd      string   `json:"cmd,omitempty"`
+	Params   []string `json:"params,omitempty"`
+	Text     string   `json:"text,omitempty"`
+	Checksum string   `json:"checksum,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+func (b *GcodeBlock) MarshalJSON() ([]byte, error) {
+	j := jsonGcodeBlock{Text: b.text, Checksum: b.checksum, Comment: b.comment}
+	if b.numbered {
+		j.N = &b.num
+	}
+	if b.cmd != nil {
+		j.Cmd = b.cmd.String()
+	}
+	for _, g := range b.params {
+		j.Params = append(j.Params, g.String())
+	}
+	return json.Marshal(j)
+}
+
+func (b *GcodeBlock) UnmarshalJSON(data []byte) error {
+	var j jsonGcodeBlock
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Comment != "" && j.Comment[0] != ';' {
+		return fmt.Errorf("comment must start with ';': %q", j.Comment)
+	}
+
+	block := GcodeBlock{text: j.Text, checksum: j.Checksum, comment: j.Comment}
+	if j.N != nil {
+		block.num, block.numbered = *j.N, true
+	}
+	if j.Cmd != "" {
+		cmd, err := ParseGcode(j.Cmd)
+		if err != nil {
+			return err
+		}
+		block.cmd = cmd
+	} else if len(j.Params) > 0 || j.Text != "" {
+		return errors.New("params without cmd")
+	}
+	for _, s := range j.Params {
+		g, err := ParseGcode(s)
+		if err != nil {
+			return err
+		}
+		block.params = append(block.params, g)
+	}
+	if block.cmd == nil && block.comment == "" {
+		return ErrEmptyString
+	}
+	*b = block
+	return nil
+}
@@ -0,0 +1,98 @@
+package fix
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+fixPreheatTime starts heating an idle tool before its M109, so the printer does not wait for it.
+
+The preheat time is (target - current temperature) / heat-up rate + "preheat.lead" seconds,
+and the line to place M104 is found by the estimated time of MotionModel.
+If the tool is idle for a shorter time than that, its cooldown is removed.
+*/
+func fixPreheatTime(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	model := NewMotionModel(ctx)
+	if model.HeatRate <= 0 {
+		return nil, errors.New("preheat.rate must be positive")
+	}
+	lead := ctx.Options.Float("preheat.lead", 0)
+
+	layers := DetectLayers(gcodes)
+	if layers.Len() == 0 {
+		ctx.Warnf("no layer found, skip")
+		return gcodes, nil
+	}
+	firstLine := layers.Layers()[0].StartLine
+	times := model.Estimate(gcodes)
+
+	var (
+		state       = NewMachineState()
+		lastTemp    [MaxTools]int // the last M104/M109 of each tool
+		lastExtrude [MaxTools]int
+		inserts     = map[int][]*GcodeBlock{} // insert before line
+	)
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+
+		if isExtruding(g, state.E, prev.E) && state.Tool >= 0 && state.Tool < MaxTools {
+			lastExtrude[state.Tool] = n
+		}
+		if !g.Is("M104") && !g.Is("M109") {
+			continue
+		}
+		tool := prev.toolOf(g)
+		if tool < 0 || tool >= MaxTools {
+			continue
+		}
+		from, cooldown := lastTemp[tool], gcodes[lastTemp[tool]]
+		lastTemp[tool] = n
+		if lastExtrude[tool] > from {
+			from, cooldown = lastExtrude[tool], nil
+		}
+
+		target, cur := state.Temps[tool], prev.Temps[tool]
+		if !g.Is("M109") || n <= firstLine || from <= firstLine || target <= cur {
+			continue
+		}
+
+		need := (target-cur)/model.HeatRate + lead
+		preheat, err := ParseGcodeBlock(fmt.Sprintf("M104 T%d S%g", tool, target))
+		if err != nil {
+			return nil, err
+		}
+
+		if times[n-1]-times[from] <= need {
+			if cooldown != nil && cooldown.Is("M104") {
+				nl, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: remove cooldown: %s)", cooldown.Format("%c %p")))
+				gcodes[from] = nl
+				ctx.Record(from, "remove cooldown of T%d, idle for %.0fs", tool, times[n-1]-times[from])
+			} else {
+				preheat.SetComment(";(Fixed: pre-heat T%d)", tool)
+				inserts[from+1] = append(inserts[from+1], preheat)
+				ctx.Record(from, "pre-heat T%d", tool)
+			}
+			continue
+		}
+
+		p := n - 1
+		for p > from && times[n-1]-times[p] < need {
+			p--
+		}
+		preheat.SetComment(";(Fixed: pre-heat %.0fs)", need)
+		inserts[p+1] = append(inserts[p+1], preheat)
+		ctx.Record(p, "pre-heat T%d %.0fs before M109", tool, need)
+	}
+
+	if len(inserts) > 0 {
+		output := make([]*GcodeBlock, 0, len(gcodes)+len(inserts))
+		for n, g := range gcodes {
+			output = append(output, inserts[n]...)
+			output = append(output, g)
+		}
+		gcodes = output
+	}
+	return removeRedundantTemps(ctx, gcodes), nil
+}
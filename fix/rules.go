@@ -0,0 +1,779 @@
+package fix
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+Rule is a rewrite rule from the config file (key "rule"), the syntax is:
+
+	selector [if condition] -> action [; action ...]
+
+selector:
+
+	M106 P1 S*   command M106 with P=1 and any S
+	G1 !E        G1 without E
+	*            any line
+	@layer       the line which starts a new layer
+
+condition is an expression, e.g. `S > 200 && layer >= 3`:
+
+	X..Z, E, S...   value of a param of the line, the rule is skipped if it is missing
+	layer, z, tool  current layer index (from 1), layer Z and tool
+	line            line number (from 1)
+	layer_height, total_layers, model, tool_head, print_mode
+	nozzle_temp(n), bed_temp(n), filament_type(n)
+	min, max, abs, round, floor, ceil
+	+ - * / % == != < <= > >= && || ! and "strings"
+
+action:
+
+	S = min(S, 200)          set a param
+	unset F                  remove a param
+	comment "text"           replace the comment
+	insert [before|after] "M600"
+	remove                   comment out the line
+
+The expressions can only read the line and the params, so a rule can not do anything else than rewriting gcodes.
+*/
+type Rule struct {
+	Source string
+
+	cmd     string // "*" any, "@layer" layer change
+	matches []ruleMatch
+	cond    ruleExpr
+	actions []ruleAction
+}
+
+type ruleMatch struct {
+	word    byte
+	value   string // empty: has param
+	absent  bool
+	numeric bool
+	num     float64
+}
+
+type ruleValue struct {
+	num   float64
+	str   string
+	isStr bool
+}
+
+func (v ruleValue) truthy() bool {
+	if v.isStr {
+		return v.str != ""
+	}
+	return v.num != 0
+}
+
+func (v ruleValue) String() string {
+	if v.isStr {
+		return v.str
+	}
+	return formatRuleNum(v.num)
+}
+
+func boolValue(b bool) ruleValue {
+	if b {
+		return ruleValue{num: 1}
+	}
+	return ruleValue{}
+}
+
+type ruleEnv struct {
+	ctx   *Context
+	block *GcodeBlock
+	line  int
+	state MachineState
+	layer int // from 1
+	z     float64
+}
+
+type ruleExpr func(env *ruleEnv) (ruleValue, error)
+
+type ruleAction struct {
+	kind  string // set, unset, comment, insert, remove
+	word  byte
+	expr  ruleExpr
+	text  string
+	after bool
+}
+
+var errRuleSkip = errors.New("param not found")
+
+// ParseRule compiles a rule
+func ParseRule(source string) (*Rule, error) {
+	r := &Rule{Source: source}
+
+	left, right, ok := cutOutsideQuotes(source, "->")
+	if !ok {
+		return nil, fmt.Errorf("rule %q: missing ->", source)
+	}
+
+	selector, cond, hasCond := strings.Cut(" "+left+" ", " if ")
+	fields := strings.Fields(selector)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("rule %q: missing selector", source)
+	}
+	r.cmd = strings.ToUpper(fields[0])
+	if r.cmd == "@LAYER" {
+		r.cmd = "@layer"
+	} else if r.cmd != "*" {
+		if _, err := ParseGcode(r.cmd); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", source, err)
+		}
+	}
+	for _, f := range fields[1:] {
+		m := ruleMatch{}
+		f = strings.ToUpper(f)
+		if f[0] == '!' {
+			m.absent = true
+			f = f[1:]
+		}
+		if f == "" || isValidWord(f[0]) != nil {
+			return nil, fmt.Errorf("rule %q: invalid param %q", source, f)
+		}
+		m.word = f[0]
+		if v := f[1:]; v != "*" && v != "" {
+			m.value = v
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				m.numeric = true
+				m.num = n
+			}
+		}
+		r.matches = append(r.matches, m)
+	}
+
+	if hasCond {
+		p := &ruleParser{}
+		if err := p.lex(cond); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", source, err)
+		}
+		expr, err := p.parseExpr()
+		if err == nil && p.peek().kind != tokEOF {
+			err = fmt.Errorf("unexpected %q", p.peek().s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", source, err)
+		}
+		r.cond = expr
+	}
+
+	p := &ruleParser{}
+	if err := p.lex(right); err != nil {
+		return nil, fmt.Errorf("rule %q: %w", source, err)
+	}
+	actions, err := p.parseActions()
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", source, err)
+	}
+	r.actions = actions
+	return r, nil
+}
+
+// match reports if the rule applies to the line, the errors of the condition are returned, except a missing param
+func (r *Rule) match(env *ruleEnv, layerStart bool) (bool, error) {
+	g := env.block
+	switch r.cmd {
+	case "*":
+	case "@layer":
+		if !layerStart {
+			return false, nil
+		}
+	default:
+		if g.cmd == nil || !g.Is(r.cmd) {
+			return false, nil
+		}
+	}
+
+	for _, m := range r.matches {
+		var addr *Gcode
+		for _, p := range g.Params() {
+			if p.Word() == m.word {
+				addr = p
+				break
+			}
+		}
+		switch {
+		case m.absent:
+			if addr != nil {
+				return false, nil
+			}
+		case addr == nil:
+			return false, nil
+		case m.value == "":
+		case m.numeric:
+			if v, ok := addr.Float(); !ok || v != m.num {
+				return false, nil
+			}
+		case addr.Addr() != m.value:
+			return false, nil
+		}
+	}
+
+	if r.cond != nil {
+		v, err := r.cond(env)
+		if err == errRuleSkip {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return v.truthy(), nil
+	}
+	return true, nil
+}
+
+func cutOutsideQuotes(s, sep string) (before, after string, found bool) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' {
+			quoted = !quoted
+		} else if !quoted && strings.HasPrefix(s[i:], sep) {
+			return s[:i], s[i+len(sep):], true
+		}
+	}
+	return s, "", false
+}
+
+func formatRuleNum(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e5)/1e5, 'f', -1, 64)
+}
+
+func applyRules(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	sources := ctx.Options.Values("rule")
+	if len(sources) == 0 {
+		return gcodes, nil
+	}
+	rules := make([]*Rule, 0, len(sources))
+	for _, s := range sources {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	output := make([]*GcodeBlock, 0, len(gcodes))
+	layers := DetectLayers(gcodes)
+	env := &ruleEnv{ctx: ctx, state: NewMachineState()}
+	for n, gcode := range gcodes {
+		env.block = gcode
+		env.line = n + 1
+		env.state.Update(gcode)
+
+		layerStart := false
+		if l, ok := layers.Layer(n); ok {
+			env.layer = l.Index + 1
+			env.z = l.Z
+			layerStart = l.StartLine == n
+		}
+
+		var before, after []*GcodeBlock
+		removed := false
+		for i, r := range rules {
+			if removed {
+				break
+			}
+			ok, err := r.match(env, layerStart)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: rule %q: %w", n+1, r.Source, err)
+			}
+			if !ok {
+				continue
+			}
+			for _, a := range r.actions {
+				if removed {
+					break // the line is replaced by the note of remove
+				}
+				switch a.kind {
+				case "set":
+					v, err := a.expr(env)
+					if err == errRuleSkip {
+						continue
+					}
+					if err != nil {
+						return nil, fmt.Errorf("line %d: rule %q: %w", n+1, r.Source, err)
+					}
+					if err := gcode.SetParam(a.word, v.String()); err != nil {
+						return nil, fmt.Errorf("line %d: rule %q: %w", n+1, r.Source, err)
+					}
+				case "unset":
+					gcode.RemoveParam(a.word)
+				case "comment":
+					gcode.SetComment(a.text)
+				case "insert":
+					g, err := ParseGcodeBlock(a.text)
+					if err != nil {
+						return nil, fmt.Errorf("rule %q: %w", r.Source, err)
+					}
+					if g.Comment() == "" {
+						g.SetComment(";(Fixed: rule %d)", i+1)
+					}
+					if a.after {
+						after = append(after, g)
+					} else {
+						before = append(before, g)
+					}
+				case "remove":
+					removed = true
+				}
+			}
+			ctx.Record(n, "rule %d: %s", i+1, r.Source)
+		}
+
+		output = append(output, before...)
+		if removed {
+			g, _ := ParseGcodeBlock(fmt.Sprintf(";(Fixed: remove by rule: %s)", gcode.Format("%c %p")))
+			output = append(output, g)
+		} else {
+			output = append(output, gcode)
+		}
+		output = append(output, after...)
+	}
+	return output, nil
+}
+
+/////////// expressions
+
+const (
+	tokEOF = iota
+	tokNum
+	tokStr
+	tokIdent
+	tokOp
+)
+
+type ruleToken struct {
+	kind int
+	s    string
+	num  float64
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) lex(s string) error {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			start := i
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+				i++
+			}
+			num, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", s[start:i])
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: tokNum, s: s[start:i], num: num})
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end == -1 {
+				return errors.New("unterminated string")
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: tokStr, s: s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(s) && (s[i] == '_' || s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' || s[i] >= '0' && s[i] <= '9') {
+				i++
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: tokIdent, s: s[start:i]})
+		default:
+			op := ""
+			if i+1 < len(s) {
+				switch s[i : i+2] {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = s[i : i+2]
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%<>!(),=;", rune(c)) {
+					return fmt.Errorf("unexpected %q", c)
+				}
+				op = string(c)
+			}
+			p.tokens = append(p.tokens, ruleToken{kind: tokOp, s: op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ruleToken{kind: tokEOF}
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.s == op
+}
+
+func (p *ruleParser) expect(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("expected %q", op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *ruleParser) parseActions() (actions []ruleAction, err error) {
+	for {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, fmt.Errorf("expected action, got %q", t.s)
+		}
+		a := ruleAction{kind: t.s}
+		switch {
+		case len(t.s) == 1 && isValidWord(t.s[0]) == nil:
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			a.kind = "set"
+			a.word = t.s[0]
+			if a.expr, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		case t.s == "unset":
+			w := p.next()
+			if w.kind != tokIdent || len(w.s) != 1 || isValidWord(w.s[0]) != nil {
+				return nil, fmt.Errorf("unset: invalid param %q", w.s)
+			}
+			a.word = w.s[0]
+		case t.s == "comment":
+			s := p.next()
+			if s.kind != tokStr {
+				return nil, errors.New("comment: expected string")
+			}
+			a.text = s.s
+			if !strings.HasPrefix(a.text, ";") {
+				a.text = "; " + a.text
+			}
+		case t.s == "insert":
+			a.after = true
+			if w := p.peek(); w.kind == tokIdent && (w.s == "before" || w.s == "after") {
+				a.after = w.s == "after"
+				p.next()
+			}
+			s := p.next()
+			if s.kind != tokStr {
+				return nil, errors.New("insert: expected string")
+			}
+			if g, err := ParseGcodeBlock(s.s); err != nil {
+				return nil, fmt.Errorf("insert: %w", err)
+			} else if g.String() == "" {
+				return nil, fmt.Errorf("insert: invalid gcode %q", s.s)
+			}
+			a.text = s.s
+		case t.s == "remove":
+		default:
+			return nil, fmt.Errorf("unknown action %q", t.s)
+		}
+		actions = append(actions, a)
+
+		if p.peek().kind == tokEOF {
+			return actions, nil
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var ruleBinaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *ruleParser) parseExpr() (ruleExpr, error) {
+	return p.parseBinary(0)
+}
+
+func (p *ruleParser) parseBinary(level int) (ruleExpr, error) {
+	if level == len(ruleBinaryOps) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		found := false
+		for _, op := range ruleBinaryOps[level] {
+			if t.kind == tokOp && t.s == op {
+				found = true
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryRuleExpr(t.s, left, right)
+	}
+}
+
+func binaryRuleExpr(op string, left, right ruleExpr) ruleExpr {
+	return func(env *ruleEnv) (ruleValue, error) {
+		l, err := left(env)
+		if err != nil {
+			return l, err
+		}
+		// short-circuit
+		switch op {
+		case "&&":
+			if !l.truthy() {
+				return boolValue(false), nil
+			}
+		case "||":
+			if l.truthy() {
+				return boolValue(true), nil
+			}
+		}
+		r, err := right(env)
+		if err != nil {
+			return r, err
+		}
+
+		switch op {
+		case "&&", "||":
+			return boolValue(r.truthy()), nil
+		case "==":
+			return boolValue(l == r), nil
+		case "!=":
+			return boolValue(l != r), nil
+		}
+		if l.isStr || r.isStr {
+			if op == "+" {
+				return ruleValue{str: l.String() + r.String(), isStr: true}, nil
+			}
+			return ruleValue{}, fmt.Errorf("invalid operation on string: %s", op)
+		}
+		switch op {
+		case "<":
+			return boolValue(l.num < r.num), nil
+		case "<=":
+			return boolValue(l.num <= r.num), nil
+		case ">":
+			return boolValue(l.num > r.num), nil
+		case ">=":
+			return boolValue(l.num >= r.num), nil
+		case "+":
+			return ruleValue{num: l.num + r.num}, nil
+		case "-":
+			return ruleValue{num: l.num - r.num}, nil
+		case "*":
+			return ruleValue{num: l.num * r.num}, nil
+		case "/":
+			if r.num == 0 {
+				return ruleValue{}, errors.New("division by zero")
+			}
+			return ruleValue{num: l.num / r.num}, nil
+		default: // %
+			if r.num == 0 {
+				return ruleValue{}, errors.New("division by zero")
+			}
+			return ruleValue{num: math.Mod(l.num, r.num)}, nil
+		}
+	}
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	if p.isOp("-") || p.isOp("!") {
+		op := p.next().s
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *ruleEnv) (ruleValue, error) {
+			v, err := x(env)
+			if err != nil {
+				return v, err
+			}
+			if op == "!" {
+				return boolValue(!v.truthy()), nil
+			}
+			if v.isStr {
+				return v, errors.New("invalid operation on string: -")
+			}
+			return ruleValue{num: -v.num}, nil
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *ruleParser) parsePrimary() (ruleExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNum:
+		return func(*ruleEnv) (ruleValue, error) { return ruleValue{num: t.num}, nil }, nil
+	case tokStr:
+		return func(*ruleEnv) (ruleValue, error) { return ruleValue{str: t.s, isStr: true}, nil }, nil
+	case tokOp:
+		if t.s == "(" {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	case tokIdent:
+		if p.isOp("(") {
+			p.next()
+			var args []ruleExpr
+			for !p.isOp(")") {
+				arg, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if !p.isOp(")") {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return ruleFunc(t.s, args)
+		}
+		return ruleVar(t.s)
+	}
+	if t.kind == tokEOF {
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.s)
+}
+
+func ruleVar(name string) (ruleExpr, error) {
+	if len(name) == 1 && isValidWord(name[0]) == nil {
+		word := name[0]
+		return func(env *ruleEnv) (ruleValue, error) {
+			var v string
+			if err := env.block.GetParam(word, &v); err != nil {
+				return ruleValue{}, errRuleSkip
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return ruleValue{str: v, isStr: true}, nil
+			}
+			return ruleValue{num: f}, nil
+		}, nil
+	}
+
+	num := func(fn func(env *ruleEnv) float64) ruleExpr {
+		return func(env *ruleEnv) (ruleValue, error) { return ruleValue{num: fn(env)}, nil }
+	}
+	str := func(fn func(env *ruleEnv) string) ruleExpr {
+		return func(env *ruleEnv) (ruleValue, error) { return ruleValue{str: fn(env), isStr: true}, nil }
+	}
+	switch name {
+	case "layer":
+		return num(func(env *ruleEnv) float64 { return float64(env.layer) }), nil
+	case "z":
+		return num(func(env *ruleEnv) float64 { return env.z }), nil
+	case "tool":
+		return num(func(env *ruleEnv) float64 { return float64(env.state.Tool) }), nil
+	case "line":
+		return num(func(env *ruleEnv) float64 { return float64(env.line) }), nil
+	case "layer_height":
+		return num(func(env *ruleEnv) float64 { return env.ctx.Params.LayerHeight }), nil
+	case "total_layers":
+		return num(func(env *ruleEnv) float64 { return float64(env.ctx.Params.TotalLayers) }), nil
+	case "model":
+		return str(func(env *ruleEnv) string { return env.ctx.Params.Model }), nil
+	case "tool_head":
+		return str(func(env *ruleEnv) string { return env.ctx.Params.ToolHead }), nil
+	case "print_mode":
+		return str(func(env *ruleEnv) string { return env.ctx.Params.PrintMode }), nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", name)
+}
+
+func ruleFunc(name string, args []ruleExpr) (ruleExpr, error) {
+	nargs := map[string]int{
+		"min": 2, "max": 2, "abs": 1, "round": 1, "floor": 1, "ceil": 1,
+		"nozzle_temp": 1, "bed_temp": 1, "filament_type": 1,
+	}
+	n, ok := nargs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s: want %d arguments, got %d", name, n, len(args))
+	}
+
+	return func(env *ruleEnv) (ruleValue, error) {
+		vs := make([]float64, len(args))
+		for i, arg := range args {
+			v, err := arg(env)
+			if err != nil {
+				return v, err
+			}
+			if v.isStr {
+				return v, fmt.Errorf("%s: want number, got %q", name, v.str)
+			}
+			vs[i] = v.num
+		}
+
+		p := env.ctx.Params
+		switch name {
+		case "nozzle_temp", "bed_temp", "filament_type":
+			list := map[string]int{
+				"nozzle_temp":   len(p.NozzleTemperatures),
+				"bed_temp":      len(p.BedTemperatures),
+				"filament_type": len(p.FilamentTypes),
+			}[name]
+			if i := int(vs[0]); i < 0 || i >= list {
+				return ruleValue{}, fmt.Errorf("%s: index %d out of range", name, i)
+			}
+		}
+		switch name {
+		case "min":
+			return ruleValue{num: math.Min(vs[0], vs[1])}, nil
+		case "max":
+			return ruleValue{num: math.Max(vs[0], vs[1])}, nil
+		case "abs":
+			return ruleValue{num: math.Abs(vs[0])}, nil
+		case "round":
+			return ruleValue{num: math.Round(vs[0])}, nil
+		case "floor":
+			return ruleValue{num: math.Floor(vs[0])}, nil
+		case "ceil":
+			return ruleValue{num: math.Ceil(vs[0])}, nil
+		case "nozzle_temp":
+			return ruleValue{num: p.NozzleTemperatures[int(vs[0])]}, nil
+		case "bed_temp":
+			return ruleValue{num: p.BedTemperatures[int(vs[0])]}, nil
+		default: // filament_type
+			return ruleValue{str: p.FilamentTypes[int(vs[0])], isStr: true}, nil
+		}
+	}, nil
+}
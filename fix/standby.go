@@ -0,0 +1,128 @@
+package fix
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StandbyRatio of the print temperature for unknown materials
+var StandbyRatio = 0.75
+
+/*
+fixStandby drops an idle tool to its standby temperature if the next use of it is more than
+"standby.after" seconds away, and makes sure it is heated again before printing.
+The preheat modifier should run after it to start heating in time.
+
+The standby temperature is "standby.temp", or "standby.ratio" of the print temperature,
+or by the material of the tool.
+*/
+func fixStandby(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	after := ctx.Options.Float("standby.after", 60)
+	times := NewMotionModel(ctx).Estimate(gcodes)
+
+	uses := map[int32][]int{} // lines of T for each tool
+	for n, g := range gcodes {
+		if g.Cmd().Word() == 'T' {
+			if t, err := g.GetToolNum(); err == nil {
+				uses[t] = append(uses[t], n)
+			}
+		}
+	}
+
+	var (
+		state   = NewMachineState()
+		inserts = map[int][]*GcodeBlock{} // insert after line
+		tracker *StateTracker             // the state at the next use, made if it is needed
+	)
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+
+		tool := prev.Tool
+		if g.Cmd().Word() != 'T' || tool < 0 || tool >= MaxTools || tool == state.Tool {
+			continue
+		}
+
+		lines := uses[tool]
+		i := sort.SearchInts(lines, n+1)
+		if i == len(lines) {
+			continue // no longer in use, see fixShutoff
+		}
+		next := lines[i]
+		idle := times[next] - times[n]
+		if idle <= after {
+			continue
+		}
+
+		printTemp := prev.Temps[tool]
+		if printTemp <= 0 && int(tool) < len(ctx.Params.NozzleTemperatures) {
+			printTemp = ctx.Params.NozzleTemperatures[tool]
+		}
+		temp := standbyTemp(ctx, tool, printTemp)
+		if printTemp <= 0 || temp >= printTemp {
+			continue
+		}
+
+		standby, err := ParseGcodeBlock(fmt.Sprintf("M104 T%d S%g ;(Fixed: standby T%d)", tool, temp, tool))
+		if err != nil {
+			return nil, err
+		}
+		inserts[n] = append(inserts[n], standby)
+		ctx.Record(n, "standby T%d at %g for %.0fs", tool, temp, idle)
+
+		if tracker == nil {
+			tracker = TrackState(gcodes)
+		}
+		if !waitsForTemp(gcodes, next, tool, tracker.At(next)) {
+			wait, _ := ParseGcodeBlock(fmt.Sprintf("M109 T%d S%g ;(Fixed: wait T%d)", tool, printTemp, tool))
+			inserts[next] = append(inserts[next], wait)
+		}
+	}
+
+	if len(inserts) == 0 {
+		checkColdExtrusion(ctx, gcodes)
+		return gcodes, nil
+	}
+	output := make([]*GcodeBlock, 0, len(gcodes)+len(inserts))
+	for n, g := range gcodes {
+		output = append(output, g)
+		output = append(output, inserts[n]...)
+	}
+	checkColdExtrusion(ctx, output)
+	return output, nil
+}
+
+func standbyTemp(ctx *Context, tool int32, printTemp float64) float64 {
+	if v := ctx.Options.Float("standby.temp", 0); v > 0 {
+		return v
+	}
+	if r := ctx.Options.Float("standby.ratio", 0); r > 0 {
+		return printTemp * r
+	}
+	if int(tool) < len(ctx.Params.FilamentTypes) {
+		if m, ok := Materials.Lookup(ctx.Params.FilamentTypes[tool]); ok {
+			return m.StandbyTemp
+		}
+	}
+	return printTemp * StandbyRatio
+}
+
+// waitsForTemp reports if there is a M109 of the tool after T at line n, before the first extrusion,
+// state is the state after line n, retracts are not extrusions in both relative and absolute E
+func waitsForTemp(gcodes []*GcodeBlock, n int, tool int32, state MachineState) bool {
+	for _, g := range gcodes[n+1:] {
+		prev := state
+		state.Update(g)
+		switch {
+		case g.Cmd().Word() == 'T':
+			return false
+		case g.Is("M109"):
+			if t, err := g.GetToolNum(); err != nil || t == tool {
+				return true
+			}
+		case isExtruding(g, state.E, prev.E):
+			return false
+		}
+	}
+	return false
+}
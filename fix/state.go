@@ -0,0 +1,226 @@
+package fix
+
+const (
+	// MaxTools is the number of tools tracked by MachineState, T >= MaxTools are ignored
+	MaxTools = 16
+
+	stateCheckpointEvery = 512
+)
+
+// MachineState is the state of the printer after executing a line
+type MachineState struct {
+	X, Y, Z, E float64
+	F          float64 // feedrate, mm/min
+	Relative   bool    // G91
+	RelativeE  bool    // M83, or G91
+	Tool       int32   // -1 before the first T
+	Temps      [MaxTools]float64
+	BedTemp    float64
+	Fans       [MaxTools]float64 // fan speed 0-255 by P
+	Layer      int               // from 1, 0 before the first layer, by comments only, see DetectLayers
+	LayerZ     float64           // Z of the layer from comments, e.g. ;Z:0.4
+
+	layerKind string // the first kind of layer marker
+}
+
+func NewMachineState() MachineState {
+	return MachineState{Tool: -1}
+}
+
+// Update executes the line
+func (s *MachineState) Update(g *GcodeBlock) {
+	if g.IsComment() {
+		m := layerMarker(g)
+		if m.kind != "" {
+			if s.layerKind == "" {
+				s.layerKind = m.kind
+			}
+			if m.kind == s.layerKind {
+				s.Layer++
+			}
+		}
+		if m.z > 0 {
+			s.LayerZ = m.z
+		}
+		return
+	}
+
+	cmd := g.Cmd()
+	switch cmd.Word() {
+	case 'T':
+		if t, err := g.GetToolNum(); err == nil && t >= 0 {
+			s.Tool = t
+		}
+		return
+	case 'G':
+	case 'M':
+	default:
+		return
+	}
+
+	switch cmd.String() {
+	case "G0", "G1", "G2", "G3":
+		s.move(g)
+	case "G28":
+		homed := false
+		for _, p := range g.Params() {
+			switch p.Word() {
+			case 'X':
+				s.X, homed = 0, true
+			case 'Y':
+				s.Y, homed = 0, true
+			case 'Z':
+				s.Z, homed = 0, true
+			}
+		}
+		if !homed {
+			s.X, s.Y, s.Z = 0, 0, 0
+		}
+	case "G90":
+		s.Relative, s.RelativeE = false, false
+	case "G91":
+		s.Relative, s.RelativeE = true, true
+	case "M82":
+		s.RelativeE = false
+	case "M83":
+		s.RelativeE = true
+	case "G92":
+		if len(g.Params()) == 0 {
+			s.X, s.Y, s.Z, s.E = 0, 0, 0, 0
+		}
+		for _, p := range g.Params() {
+			v, ok := p.Float()
+			if !ok {
+				continue
+			}
+			switch p.Word() {
+			case 'X':
+				s.X = v
+			case 'Y':
+				s.Y = v
+			case 'Z':
+				s.Z = v
+			case 'E':
+				s.E = v
+			}
+		}
+	case "M104", "M109":
+		if v, ok := g.paramFloat('S'); ok {
+			if t := s.toolOf(g); t >= 0 && t < MaxTools {
+				s.Temps[t] = v
+			}
+		}
+	case "M140", "M190":
+		if v, ok := g.paramFloat('S'); ok {
+			s.BedTemp = v
+		}
+	case "M106", "M107":
+		p := 0
+		if v, ok := g.paramFloat('P'); ok {
+			p = int(v)
+		}
+		if p < 0 || p >= MaxTools {
+			return
+		}
+		if cmd.Is("M107") {
+			s.Fans[p] = 0
+		} else if v, ok := g.paramFloat('S'); ok {
+			s.Fans[p] = v
+		} else {
+			s.Fans[p] = 255
+		}
+	}
+}
+
+func (s *MachineState) move(g *GcodeBlock) {
+	for _, p := range g.Params() {
+		v, ok := p.Float()
+		if !ok {
+			continue
+		}
+		switch p.Word() {
+		case 'X':
+			s.X = s.axis(s.X, v, s.Relative)
+		case 'Y':
+			s.Y = s.axis(s.Y, v, s.Relative)
+		case 'Z':
+			s.Z = s.axis(s.Z, v, s.Relative)
+		case 'E':
+			s.E = s.axis(s.E, v, s.RelativeE)
+		case 'F':
+			s.F = v
+		}
+	}
+}
+
+func (s *MachineState) axis(cur, v float64, relative bool) float64 {
+	if relative {
+		return cur + v
+	}
+	return v
+}
+
+// toolOf returns the tool of M104/M109, or the current tool if T is not specified
+func (s *MachineState) toolOf(g *GcodeBlock) int32 {
+	if t, err := g.GetToolNum(); err == nil && t >= 0 {
+		return t
+	}
+	return s.Tool
+}
+
+// StateTracker gives the MachineState at any line of gcodes
+type StateTracker struct {
+	gcodes      []*GcodeBlock
+	checkpoints []MachineState // state before line i*stateCheckpointEvery
+
+	// the last queried state, makes sequential queries cheap
+	cur  MachineState
+	curN int
+}
+
+// TrackState scans gcodes once, the tracker is invalid if gcodes is modified.
+// It is not safe for concurrent use.
+func TrackState(gcodes []*GcodeBlock) *StateTracker {
+	t := &StateTracker{
+		gcodes:      gcodes,
+		checkpoints: make([]MachineState, 0, len(gcodes)/stateCheckpointEvery+1),
+		curN:        -1,
+	}
+	s := NewMachineState()
+	for n, g := range gcodes {
+		if n%stateCheckpointEvery == 0 {
+			t.checkpoints = append(t.checkpoints, s)
+		}
+		s.Update(g)
+	}
+	t.cur = NewMachineState()
+	return t
+}
+
+// At returns the state after executing line n, n = -1 is the initial state
+func (t *StateTracker) At(n int) MachineState {
+	if n < 0 || len(t.gcodes) == 0 {
+		return NewMachineState()
+	}
+	if n >= len(t.gcodes) {
+		n = len(t.gcodes) - 1
+	}
+
+	if n < t.curN || n-t.curN > stateCheckpointEvery {
+		i := n / stateCheckpointEvery
+		t.cur = t.checkpoints[i]
+		t.curN = i*stateCheckpointEvery - 1
+	}
+	for t.curN < n {
+		t.curN++
+		t.cur.Update(t.gcodes[t.curN])
+	}
+	return t.cur
+}
+
+func (b *GcodeBlock) paramFloat(p byte) (float64, bool) {
+	if g := b.param(p); g != nil {
+		return g.Float()
+	}
+	return 0, false
+}
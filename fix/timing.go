@@ -0,0 +1,95 @@
+package fix
+
+import (
+	"math"
+)
+
+// MotionModel is a simple model of the printer to estimate the time of each line
+type MotionModel struct {
+	Accel    float64 // mm/s^2
+	MaxSpeed float64 // mm/s
+	HeatRate float64 // heat-up rate of nozzles, °C/s
+	BedRate  float64 // heat-up rate of the bed, °C/s
+}
+
+// NewMotionModel returns the model of the printer, "time.accel", "time.max_speed",
+// "preheat.rate" and "time.bed_rate" options overwrite the defaults.
+func NewMotionModel(ctx *Context) MotionModel {
+	m := MotionModel{
+		Accel:    1000,
+		MaxSpeed: 300,
+		HeatRate: 2,
+		BedRate:  0.3,
+	}
+	switch {
+	case ctx.Params.Model == ModelJ1:
+		m.Accel = 3000
+		m.MaxSpeed = 350
+		m.HeatRate = 3
+		m.BedRate = 0.8
+	case ctx.Params.ToolHead == ToolheadDual:
+		m.HeatRate = 1.5
+	}
+	m.Accel = ctx.Options.Float("time.accel", m.Accel)
+	m.MaxSpeed = ctx.Options.Float("time.max_speed", m.MaxSpeed)
+	m.HeatRate = ctx.Options.Float("preheat.rate", m.HeatRate)
+	m.BedRate = ctx.Options.Float("time.bed_rate", m.BedRate)
+	return m
+}
+
+// Estimate returns the elapsed seconds at the end of each line
+func (m MotionModel) Estimate(gcodes []*GcodeBlock) []float64 {
+	var (
+		times   = make([]float64, len(gcodes))
+		state   = NewMachineState()
+		elapsed float64
+	)
+	for n, g := range gcodes {
+		prev := state
+		state.Update(g)
+
+		switch g.Cmd().String() {
+		case "G0", "G1", "G2", "G3":
+			dx, dy, dz := state.X-prev.X, state.Y-prev.Y, state.Z-prev.Z
+			d := math.Sqrt(dx*dx + dy*dy + dz*dz)
+			if d == 0 {
+				d = math.Abs(state.E - prev.E)
+			}
+			elapsed += m.moveTime(d, state.F/60)
+		case "G4":
+			if v, ok := g.paramFloat('P'); ok {
+				elapsed += v / 1000
+			} else if v, ok := g.paramFloat('S'); ok {
+				elapsed += v
+			}
+		case "M109":
+			if t := prev.toolOf(g); t >= 0 && t < MaxTools && m.HeatRate > 0 {
+				elapsed += math.Max(0, state.Temps[t]-prev.Temps[t]) / m.HeatRate
+			}
+		case "M190":
+			if m.BedRate > 0 {
+				elapsed += math.Max(0, state.BedTemp-prev.BedTemp) / m.BedRate
+			}
+		}
+		times[n] = elapsed
+	}
+	return times
+}
+
+// moveTime of a trapezoid profile, starts and stops at speed 0
+func (m MotionModel) moveTime(d, v float64) float64 {
+	if d <= 0 {
+		return 0
+	}
+	if v <= 0 || v > m.MaxSpeed {
+		v = m.MaxSpeed
+	}
+	if m.Accel <= 0 {
+		return d / v
+	}
+	if d < v*v/m.Accel {
+		// never reaches v
+		return 2 * math.Sqrt(d/m.Accel)
+	}
+	return d/v + v/m.Accel
+}
@@ -0,0 +1,527 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// steps of a tool change template
+const (
+	StepRetract    = "retract"    // retract by the switch retraction of the old tool
+	StepPark       = "park"       // lift Z by "toolchange.lift"
+	StepToolChange = "toolchange" // T
+	StepWait       = "wait"       // M109 if the new tool is not at the temperature
+	StepPurge      = "purge"      // extrude by the material pair, see PurgeLength
+	StepUnretract  = "unretract"  // extrude back the retraction
+	StepReturn     = "return"     // back to the Z of the slicer
+
+	// steps of a color change on the single nozzle, they replace T
+	StepMessage = "message" // M117 shows the new filament on the touchscreen
+	StepBeep    = "beep"    // M300
+	StepPause   = "pause"   // M600, the user swaps the filament
+)
+
+/*
+ToolChangeTemplates are the steps of a tool change, the key is "model/print mode", "model" or "" for the default.
+A nil template keeps the tool changes of the slicer.
+
+The dual extruders module of A-series lifts Z to keep the other nozzle away from the print,
+J1 parks the idle head by the firmware, and there is no tool change in duplication and mirror modes.
+*/
+var ToolChangeTemplates = map[string][]string{
+	"":                                   {StepRetract, StepPark, StepToolChange, StepWait, StepPurge, StepUnretract, StepReturn},
+	ModelJ1:                              {StepRetract, StepToolChange, StepWait, StepPurge, StepUnretract, StepReturn},
+	ModelJ1 + "/" + PrintModeDuplication: nil,
+	ModelJ1 + "/" + PrintModeMirror:      nil,
+}
+
+type toolChangeConfig struct {
+	name         string // of the change in comments and logs
+	steps        []string
+	lift         float64 // mm
+	zSpeed       float64 // mm/min
+	retractSpeed float64 // mm/min
+	purgeSpeed   float64 // mm/min
+	purge        float64 // mm, < 0 by PurgeLength
+
+	// color change on the single nozzle
+	single       bool    // all tools are the nozzle T0
+	parkX, parkY float64 // NaN to park by Z only
+	travelSpeed  float64 // mm/min
+	beep, pause  string  // commands
+}
+
+func newToolChangeConfig(ctx *Context) (c toolChangeConfig, err error) {
+	c = toolChangeConfig{
+		name:         "tool change",
+		lift:         ctx.Options.Float("toolchange.lift", 1),
+		zSpeed:       ctx.Options.Float("toolchange.z_speed", 3000),
+		retractSpeed: ctx.Options.Float("toolchange.retract_speed", 2400),
+		purgeSpeed:   ctx.Options.Float("toolchange.purge_speed", 300),
+		purge:        -1,
+		parkX:        math.NaN(),
+		parkY:        math.NaN(),
+	}
+	if v := ctx.Options.Str("toolchange.steps", ""); v != "" {
+		c.steps, err = parseSteps("toolchange.steps", v, StepToolChange,
+			StepRetract, StepPark, StepToolChange, StepWait, StepPurge, StepUnretract, StepReturn)
+		return c, err
+	}
+	for _, key := range []string{ctx.Params.Model + "/" + ctx.Params.PrintMode, ctx.Params.Model, ""} {
+		if steps, ok := ToolChangeTemplates[key]; ok {
+			c.steps = steps
+			break
+		}
+	}
+	return c, nil
+}
+
+// parseSteps parses the steps of option key, they must have the step which replaces T
+func parseSteps(key, v, required string, valid ...string) (steps []string, err error) {
+	found := false
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		ok := false
+		for _, x := range valid {
+			ok = ok || s == x
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown step of %s: %q", key, s)
+		}
+		found = found || s == required
+		steps = append(steps, s)
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no %q", key, required)
+	}
+	return steps, nil
+}
+
+// split the steps before the tool change (or the pause of a color change), and the others
+func (c toolChangeConfig) split() (pre, post []string) {
+	for i, s := range c.steps {
+		if s == StepToolChange || s == StepPause {
+			return c.steps[:i], c.steps[i:]
+		}
+	}
+	return nil, c.steps
+}
+
+// nozzle of the tool
+func (c toolChangeConfig) nozzle(tool int32) int32 {
+	if c.single && tool >= 0 {
+		return 0
+	}
+	return tool
+}
+
+/*
+PurgeLength returns the filament (mm) to purge after switching from a material to another one,
+"toolchange.purge.FROM-TO" sets it for a pair, e.g. toolchange.purge.PLA-PETG = 5.
+
+Otherwise it is "toolchange.purge" (0 on the wipe tower which purges itself, 1 without it),
+increased by 50% for every 25°C that the new material needs more.
+*/
+func PurgeLength(ctx *Context, from, to string, tower bool) float64 {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if v := ctx.Options.Float(fmt.Sprintf("toolchange.purge.%s-%s", from, to), -1); v >= 0 {
+		return v
+	}
+	base := 1.0
+	if tower {
+		base = 0
+	}
+	base = ctx.Options.Float("toolchange.purge", base)
+
+	m1, ok1 := Materials.Lookup(from)
+	m2, ok2 := Materials.Lookup(to)
+	if ok1 && ok2 && m2.MinExtrudeTemp > m1.MinExtrudeTemp {
+		base *= 1 + (m2.MinExtrudeTemp-m1.MinExtrudeTemp)/25*0.5
+	}
+	return math.Round(base*100) / 100
+}
+
+// toolChange is a block of lines [start, end) which changes the tool at line t
+type toolChange struct {
+	start, end int
+	t          int
+	from, to   int32
+	tower      bool // the block is on the wipe tower
+}
+
+// findToolChanges finds the blocks of ; CP TOOLCHANGE START to WIPE or END,
+// and the retractions, Z hops and temperatures around a T without the markers.
+func findToolChanges(gcodes []*GcodeBlock) (changes []toolChange) {
+	var (
+		state = NewMachineState()
+		start = -1 // of the marked block
+		last  = 0  // end of the last block
+	)
+	for n := 0; n < len(gcodes); n++ {
+		g := gcodes[n]
+		prev := state
+		state.Update(g)
+
+		switch {
+		case g.IsComment() && g.InComment("; CP TOOLCHANGE START"):
+			start = n
+			continue
+		case g.IsComment() && start >= 0 && (g.InComment("; CP TOOLCHANGE WIPE") || g.InComment("; CP TOOLCHANGE END")):
+			start = -1
+			continue
+		case g.Cmd().Word() != 'T' || prev.Tool < 0 || state.Tool == prev.Tool:
+			continue
+		}
+
+		c := toolChange{start: n, end: n + 1, t: n, from: prev.Tool, to: state.Tool}
+		if start >= 0 {
+			c.start, c.tower = start, true
+			for c.end < len(gcodes) && !gcodes[c.end].InComment("; CP TOOLCHANGE WIPE") && !gcodes[c.end].InComment("; CP TOOLCHANGE END") {
+				c.end++
+			}
+			start = -1
+		} else {
+			for c.start > last && isToolChangeNoise(gcodes[c.start-1]) {
+				c.start--
+			}
+			for c.end < len(gcodes) && isToolChangeNoise(gcodes[c.end]) {
+				c.end++
+			}
+		}
+		// keep the state of the skipped lines
+		for n++; n < c.end; n++ {
+			state.Update(gcodes[n])
+		}
+		n--
+		last = c.end
+		changes = append(changes, c)
+	}
+	return
+}
+
+// isToolChangeNoise reports if the line is a retraction, Z hop, or temperature around a tool change
+func isToolChangeNoise(g *GcodeBlock) bool {
+	switch {
+	case g.String() == "":
+		return true
+	case g.Is("G0"), g.Is("G1"):
+		return !g.HasParam('X') && !g.HasParam('Y') && (g.HasParam('E') || g.HasParam('Z'))
+	case g.Is("G10"), g.Is("G11"), g.Is("M104"), g.Is("M109"):
+		return true
+	case g.Is("G4"):
+		return g.Format("%p") == "S0" || g.Format("%p") == "P0"
+	}
+	return false
+}
+
+/*
+rewriteToolChanges replaces the tool changes of the slicer by the steps of ToolChangeTemplates,
+or "toolchange.steps" e.g. "retract,toolchange,wait,unretract".
+
+Retractions, Z hops and temperatures of the new tool are replaced, other lines (moves, fans, comments) are kept
+in place. The Z, feedrate and absolute E of the slicer are restored before the next move.
+*/
+func rewriteToolChanges(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	cfg, err := newToolChangeConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.steps) == 0 {
+		return gcodes, nil
+	}
+	changes := findToolChanges(gcodes)
+	if len(changes) == 0 {
+		return gcodes, nil
+	}
+	return writeToolChanges(ctx, gcodes, cfg, changes, nil), nil
+}
+
+// writeToolChanges writes the changes by the steps of cfg, tag returns the comment of the i-th change
+func writeToolChanges(ctx *Context, gcodes []*GcodeBlock, cfg toolChangeConfig, changes []toolChange, tag func(i int, c toolChange) string) []*GcodeBlock {
+	var (
+		output = make([]*GcodeBlock, 0, len(gcodes)+len(changes)*8)
+		state  = NewMachineState() // of the slicer
+		temps  [MaxTools]float64   // of the output
+		stable [MaxTools]bool      // M109 is done at temps
+		ci     int
+	)
+	heat := func(g *GcodeBlock, tool int32) {
+		tool = cfg.nozzle(tool)
+		if v, ok := g.paramFloat('S'); ok && tool >= 0 && tool < MaxTools {
+			stable[tool] = g.Is("M109") || (stable[tool] && temps[tool] == v)
+			temps[tool] = v
+		}
+	}
+
+	for n := 0; n < len(gcodes); n++ {
+		g := gcodes[n]
+		if ci < len(changes) && changes[ci].start == n && !state.Relative {
+			c := changes[ci]
+			ci++
+
+			tc := toolChangeWriter{ctx: ctx, cfg: cfg, change: c, output: &output, heat: heat, temps: &temps, stable: &stable}
+			if tag != nil {
+				tc.tag = tag(ci-1, c)
+			}
+			state = tc.write(gcodes, state)
+			ctx.Record(c.t, "%s T%d -> T%d", cfg.name, c.from, c.to)
+			n = c.end - 1
+			continue
+		}
+		if ci < len(changes) && changes[ci].start == n {
+			ctx.Warnf("line %d: %s in relative mode is not supported", n+1, cfg.name)
+			ci++
+		}
+
+		prev := state
+		state.Update(g)
+		if g.Is("M104") || g.Is("M109") {
+			heat(g, prev.toolOf(g))
+		}
+		output = append(output, g)
+	}
+	return output
+}
+
+type toolChangeWriter struct {
+	ctx    *Context
+	cfg    toolChangeConfig
+	change toolChange
+	output *[]*GcodeBlock
+	heat   func(g *GcodeBlock, tool int32)
+	temps  *[MaxTools]float64
+	stable *[MaxTools]bool
+
+	tag                                 string // comment of the change
+	tagged                              bool
+	parkZ                               float64 // 0 if not parked
+	xyDesync, zDesync, fDesync, eDesync bool
+}
+
+// write outputs the lines of the block and the steps, returns the state of the slicer after the block.
+// The steps before T run at the first retraction of the slicer, or at T.
+func (w *toolChangeWriter) write(gcodes []*GcodeBlock, state MachineState) MachineState {
+	var (
+		c         = w.change
+		absE      = !state.RelativeE
+		target    float64 // temperature of the new tool
+		pre, post = w.cfg.split()
+		preDone   bool
+	)
+
+	for n := c.start; n < c.end; n++ {
+		g := gcodes[n]
+		prev := state
+		state.Update(g)
+
+		if n == c.t {
+			if !preDone {
+				w.run(pre, prev, target, absE)
+			}
+			target = w.targetAfter(gcodes, n, target)
+			w.run(post, state, target, absE)
+			continue
+		}
+
+		drop := false
+		switch {
+		case g.Is("M104"), g.Is("M109"):
+			if _, err := g.GetToolNum(); err != nil && c.tower && n < c.t {
+				drop = true // no tool num is an invalid cmd, see fixOrcaToolUnload
+			} else if prev.toolOf(g) == c.to {
+				if v, ok := g.paramFloat('S'); ok {
+					target = v
+				}
+				drop = true
+			}
+		case g.Is("G0"), g.Is("G1"):
+			drop = !g.HasParam('X') && !g.HasParam('Y') && (g.HasParam('E') || g.HasParam('Z'))
+		case g.Is("G10"), g.Is("G11"):
+			drop = true
+		case g.Is("G92"):
+			drop = g.HasParam('E') && !g.HasParam('X') && !g.HasParam('Y') && !g.HasParam('Z')
+		case g.Is("G4"):
+			drop = g.Format("%p") == "S0" || g.Format("%p") == "P0"
+		}
+
+		if drop {
+			if !preDone && n < c.t && (state.E < prev.E || g.Is("G10")) {
+				w.run(pre, prev, target, absE)
+				preDone = true
+			}
+			w.zDesync = w.zDesync || state.Z != prev.Z
+			w.fDesync = w.fDesync || state.F != prev.F
+			w.eDesync = w.eDesync || state.E != prev.E
+			continue
+		}
+
+		if g.Is("G0") || g.Is("G1") || g.Is("G2") || g.Is("G3") {
+			w.restore(prev, absE, g.HasParam('F'))
+		}
+		if g.Is("M104") || g.Is("M109") {
+			w.heat(g, prev.toolOf(g))
+		}
+		*w.output = append(*w.output, g)
+	}
+	w.parkZ = 0
+	w.restore(state, absE, false)
+	return state
+}
+
+// targetAfter finds the temperature of the new tool after T in the block
+func (w *toolChangeWriter) targetAfter(gcodes []*GcodeBlock, t int, target float64) float64 {
+	state := NewMachineState()
+	state.Tool = w.change.to
+	for _, g := range gcodes[t+1 : w.change.end] {
+		if (g.Is("M104") || g.Is("M109")) && state.toolOf(g) == w.change.to {
+			if v, ok := g.paramFloat('S'); ok {
+				target = v
+			}
+		}
+	}
+	return target
+}
+
+func (w *toolChangeWriter) emit(format string, args ...any) {
+	if g, err := ParseGcodeBlock(fmt.Sprintf(format, args...)); err == nil {
+		*w.output = append(*w.output, g)
+	}
+}
+
+// restore the X/Y, Z, feedrate and E of the slicer, Z is not lower than the park position
+func (w *toolChangeWriter) restore(s MachineState, absE bool, hasF bool) {
+	if w.xyDesync {
+		w.emit("G0 X%.3f Y%.3f F%g", s.X, s.Y, w.cfg.travelSpeed)
+		w.xyDesync, w.fDesync = false, true
+	}
+	if w.zDesync && s.Z >= w.parkZ {
+		w.emit("G1 Z%.3f F%g", s.Z, w.cfg.zSpeed)
+		w.zDesync, w.fDesync, w.parkZ = false, true, 0
+	}
+	if w.fDesync && !hasF && s.F > 0 {
+		w.emit("G1 F%g", s.F)
+	}
+	w.fDesync = false
+	if w.eDesync && absE {
+		w.emit("G92 E%.5f", s.E)
+	}
+	w.eDesync = false
+}
+
+func (w *toolChangeWriter) run(steps []string, s MachineState, target float64, absE bool) {
+	var (
+		ctx      = w.ctx
+		c        = w.change
+		retract  = w.retraction(w.cfg.nozzle(c.from))
+		nozzle   = w.cfg.nozzle(c.to)
+		from, to = w.material(c.from), w.material(c.to)
+	)
+	purge := w.cfg.purge
+	if purge < 0 {
+		purge = PurgeLength(ctx, from, to, c.tower)
+	}
+
+	if !w.tagged {
+		if w.tag == "" {
+			w.tag = fmt.Sprintf(";(Fixed: %s T%d -> T%d)", w.cfg.name, c.from, c.to)
+		}
+		w.emit("%s", w.tag)
+		w.tagged = true
+	}
+	relative := false // M83 is set for E steps if absolute
+	extrude := func(format string, args ...any) {
+		if absE && !relative {
+			w.emit("M83")
+			relative = true
+		}
+		w.emit(format, args...)
+		w.fDesync, w.eDesync = true, true
+	}
+	for _, step := range steps {
+		switch step {
+		case StepRetract:
+			if retract > 0 {
+				extrude("G1 E-%.5f F%g", retract, w.cfg.retractSpeed)
+			}
+		case StepPark:
+			if w.cfg.lift > 0 {
+				w.parkZ = s.Z + w.cfg.lift
+				w.emit("G1 Z%.3f F%g", w.parkZ, w.cfg.zSpeed)
+				w.zDesync, w.fDesync = true, true
+			}
+			if !math.IsNaN(w.cfg.parkX) && !math.IsNaN(w.cfg.parkY) {
+				w.emit("G0 X%.3f Y%.3f F%g", w.cfg.parkX, w.cfg.parkY, w.cfg.travelSpeed)
+				w.xyDesync, w.fDesync = true, true
+			}
+		case StepToolChange:
+			w.emit("T%d", c.to)
+		case StepMessage:
+			w.emit("M117 Load T%d %s", c.to, to)
+		case StepBeep:
+			if w.cfg.beep != "" {
+				w.emit("%s", w.cfg.beep)
+			}
+		case StepPause:
+			w.emit("%s", w.cfg.pause)
+		case StepWait:
+			if nozzle < 0 || nozzle >= MaxTools {
+				continue
+			}
+			if target <= 0 {
+				target = w.temps[nozzle]
+			}
+			if target <= 0 && int(c.to) < len(ctx.Params.NozzleTemperatures) {
+				target = ctx.Params.NozzleTemperatures[c.to]
+			}
+			if target > 0 && !(w.stable[nozzle] && w.temps[nozzle] == target) {
+				if w.cfg.single {
+					w.emit("M109 S%g", target)
+				} else {
+					w.emit("M109 T%d S%g", nozzle, target)
+				}
+				w.temps[nozzle], w.stable[nozzle] = target, true
+			}
+		case StepPurge:
+			if purge > 0 {
+				extrude("G1 E%.5f F%g", purge, w.cfg.purgeSpeed)
+			}
+		case StepUnretract:
+			if retract > 0 {
+				extrude("G1 E%.5f F%g", retract, w.cfg.retractSpeed)
+			}
+		case StepReturn:
+			// lower before the next move
+			if w.parkZ > 0 {
+				w.parkZ, w.zDesync = 0, true
+			}
+		}
+	}
+	if relative {
+		w.emit("M82")
+	}
+}
+
+// material of the tool, by the filament_type of the slicer which has all tools
+func (w *toolChangeWriter) material(tool int32) string {
+	p := w.ctx.Params
+	if tool >= 0 && int(tool) < len(p.SlicerFilaments) && p.SlicerFilaments[tool] != "" {
+		return p.SlicerFilaments[tool]
+	}
+	if tool >= 0 && int(tool) < len(p.FilamentTypes) {
+		return p.FilamentTypes[tool]
+	}
+	return ""
+}
+
+// retraction of the tool for switching, or the normal retraction
+func (w *toolChangeWriter) retraction(tool int32) float64 {
+	p := w.ctx.Params
+	if tool >= 0 && int(tool) < len(p.SwitchRetraction) && p.SwitchRetraction[tool] > 0 {
+		return p.SwitchRetraction[tool]
+	}
+	if tool >= 0 && int(tool) < len(p.Retractions) && p.Retractions[tool] > 0 {
+		return p.Retractions[tool]
+	}
+	return 0
+}
@@ -0,0 +1,344 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Nozzles of Snapmaker printers, the tools of the slicer are mapped to them
+const Nozzles = 2
+
+// ToolMap maps the tools of the slicer to the nozzles, nil is the default Tn -> T(n%2)
+type ToolMap map[int32]int32
+
+// NewToolMap parses "toolmap", e.g. "0:1,1:0,2:0,3:1" swaps T0 and T1, T2 prints by T0 and T3 by T1.
+func NewToolMap(ctx *Context) (ToolMap, error) {
+	v := ctx.Options.Str("toolmap", "")
+	if v == "" {
+		return nil, nil
+	}
+	m := ToolMap{}
+	for _, pair := range strings.Split(v, ",") {
+		t, n, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		tool, err1 := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(t), "T"), 10, 32)
+		nozzle, err2 := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(n), "T"), 10, 32)
+		if !ok || err1 != nil || err2 != nil || tool < 0 || nozzle < 0 || nozzle >= Nozzles {
+			return nil, fmt.Errorf("invalid toolmap %q, want tool:nozzle, the nozzle is 0 or 1", pair)
+		}
+		if _, dup := m[int32(tool)]; dup {
+			return nil, fmt.Errorf("invalid toolmap, T%d is mapped twice", tool)
+		}
+		m[int32(tool)] = int32(nozzle)
+	}
+	return m, nil
+}
+
+// Of returns the nozzle of the tool
+func (m ToolMap) Of(tool int32) (int32, bool) {
+	if tool < 0 {
+		return tool, false
+	}
+	if m == nil {
+		return tool % Nozzles, true
+	}
+	nozzle, ok := m[tool]
+	return nozzle, ok
+}
+
+// per-tool settings of the slicer, they are reduced to the nozzles for ParseParams()
+var toolSettings = []string{
+	"; filament used [",
+	"; filament_type = ",
+	"; filament_retraction_length = ",
+	"; filament_retract_length = ",
+	"; retract_length = ",
+	"; retraction_length = ",
+	"; retract_length_toolchange = ",
+	"; nozzle_temperature_initial_layer = ",
+	"; first_layer_temperature = ",
+	"; hot_plate_temp_initial_layer = ",
+	"; first_layer_bed_temperature = ",
+	"; nozzle_diameter = ",
+	"; filament_diameter = ",
+}
+
+// toolUsage is what the tools of the slicer do in the file
+type toolUsage struct {
+	used      map[int32]bool // selected by T
+	referred  map[int32]bool // by T/M104/M106/M109/M301...
+	materials []string       // filament_type of the slicer
+	colors    []string       // filament_colour of the slicer
+}
+
+func scanToolUsage(gcodes []*GcodeBlock) toolUsage {
+	var (
+		u  = toolUsage{used: map[int32]bool{}, referred: map[int32]bool{}}
+		mu sync.Mutex
+	)
+	GoInParallelAndWait(func(wi, wn int) {
+		used, referred := map[int32]bool{}, map[int32]bool{}
+		var materials, colors []string
+		for n := wi; n < len(gcodes); n += wn {
+			g := gcodes[n]
+			if g.IsComment() {
+				if v, ok := getSetting(g.Comment(), "filament_type"); ok {
+					materials = split(v)
+				} else if v, ok := getSetting(g.Comment(), "filament_colour"); ok {
+					colors = split(v)
+				}
+				continue
+			}
+			if word, param := toolParam(g); word != 0 {
+				if tool, err := g.GetToolNum(); err == nil && tool >= 0 {
+					referred[tool] = true
+					if param == 0 {
+						used[tool] = true
+					}
+				}
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for t := range used {
+			u.used[t] = true
+		}
+		for t := range referred {
+			u.referred[t] = true
+		}
+		if materials != nil {
+			u.materials = materials
+		}
+		if colors != nil {
+			u.colors = colors
+		}
+	})
+	return u
+}
+
+// toolParam returns the word of the command and the param of the tool number, 0 is the address of T
+func toolParam(g *GcodeBlock) (word, param byte) {
+	switch g.Cmd().Word() {
+	case 'T':
+		return 'T', 0
+	case 'M':
+		switch g.Cmd().Addr() {
+		case "106", "107": // fan uses P
+			param = 'P'
+		case "104", "109":
+			param = 'T'
+		case "301", "303":
+			param = 'E'
+		default:
+			return 0, 0
+		}
+		if g.HasParam(param) {
+			return 'M', param
+		}
+	}
+	return 0, 0
+}
+
+// sources returns the used tools of each nozzle, or the lowest mapped tool if none of them is used
+func (u toolUsage) sources(m ToolMap) (sources [Nozzles][]int32) {
+	seen := map[int32]bool{}
+	for t := int32(0); t < Nozzles; t++ {
+		seen[t] = true
+	}
+	for t := range u.referred {
+		seen[t] = true
+	}
+	for t := range m {
+		seen[t] = true
+	}
+	tools := make([]int32, 0, len(seen))
+	for t := range seen {
+		tools = append(tools, t)
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i] < tools[j] })
+
+	for _, t := range tools {
+		if nozzle, ok := m.Of(t); ok && u.used[t] {
+			sources[nozzle] = append(sources[nozzle], t)
+		}
+	}
+	for nozzle := range sources {
+		if len(sources[nozzle]) > 0 {
+			continue
+		}
+		for _, t := range tools {
+			if n, ok := m.Of(t); ok && int(n) == nozzle {
+				sources[nozzle] = []int32{t}
+				break
+			}
+		}
+	}
+	return
+}
+
+// materialOf returns the filament_type of the tool, "" if unknown
+func (u toolUsage) materialOf(tool int32) string {
+	if int(tool) < len(u.materials) {
+		if m := strings.TrimSpace(u.materials[tool]); m != "-" {
+			return m
+		}
+	}
+	return ""
+}
+
+// describe the filament of the tool, e.g. "T2 PLA #00FF00"
+func (u toolUsage) describe(tool int32) string {
+	s := fmt.Sprintf("T%d", tool)
+	if m := u.materialOf(tool); m != "" {
+		s += " " + m
+	}
+	if int(tool) < len(u.colors) && strings.TrimSpace(u.colors[tool]) != "" {
+		s += " " + strings.TrimSpace(u.colors[tool])
+	}
+	return s
+}
+
+/*
+replaceToolNum maps the tools of the slicer to the nozzles by "toolmap", the default is Tn -> T(n%2),
+Snapmaker printers have 2 nozzles at most, but more tools in the slicer can simplify the multi-material settings.
+
+T/M104/M109 T, M106/M107 P and M301/M303 E are replaced, and the per-tool settings of the slicer are reduced
+to the nozzles: each nozzle takes the settings of its used tools, the filament used of them are summed.
+The tools mapped to the same nozzle must print the same material.
+*/
+func replaceToolNum(ctx *Context, gcodes []*GcodeBlock) ([]*GcodeBlock, error) {
+	m, err := NewToolMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mapTools(ctx, gcodes, m, scanToolUsage(gcodes), m != nil)
+}
+
+// mapTools replaces the tools by m, the settings are reduced by the usage of the tools,
+// it fails if the tools of a nozzle print different materials and strict, or warns.
+func mapTools(ctx *Context, gcodes []*GcodeBlock, m ToolMap, usage toolUsage, strict bool) ([]*GcodeBlock, error) {
+	referred := make([]int32, 0, len(usage.referred))
+	for t := range usage.referred {
+		referred = append(referred, t)
+	}
+	sort.Slice(referred, func(i, j int) bool { return referred[i] < referred[j] })
+	for _, t := range referred {
+		if _, ok := m.Of(t); !ok {
+			return nil, fmt.Errorf("T%d is not in the toolmap", t)
+		}
+	}
+
+	sources := usage.sources(m)
+	for nozzle, tools := range sources {
+		for i := 1; i < len(tools); i++ {
+			t := tools[i]
+			a, b := usage.materialOf(tools[0]), usage.materialOf(t)
+			if a == "" || b == "" || strings.EqualFold(a, b) {
+				continue
+			}
+			msg := fmt.Sprintf("T%d prints %s but T%d prints %s, both are mapped to T%d", tools[0], a, t, b, nozzle)
+			if strict {
+				return nil, fmt.Errorf("%s", msg)
+			}
+			ctx.Warnf("%s", msg)
+		}
+	}
+	return replaceTools(ctx, gcodes, m, sources, false), nil
+}
+
+// replaceTools replaces the tools by m and reduces the settings to the source tools of the nozzles,
+// only the filament used are summed if usedOnly, the other settings are kept per tool.
+func replaceTools(ctx *Context, gcodes []*GcodeBlock, m ToolMap, sources [Nozzles][]int32, usedOnly bool) []*GcodeBlock {
+	GoInParallelAndWait(func(wi, wn int) {
+		for n := wi; n < len(gcodes); n += wn {
+			g := gcodes[n]
+			if g.IsComment() {
+				if usedOnly && !strings.HasPrefix(g.Comment(), "; filament used [") {
+					continue
+				}
+				if comment, ok := reduceToolSettings(g.Comment(), sources); ok {
+					g.SetComment(comment)
+				}
+				continue
+			}
+			word, param := toolParam(g)
+			if word == 0 {
+				continue
+			}
+			tool, err := g.GetToolNum()
+			if err != nil {
+				continue
+			}
+			nozzle, ok := m.Of(tool)
+			if !ok {
+				continue
+			}
+			if word == 'T' {
+				g.Cmd().SetAddr(nozzle)
+			} else {
+				g.SetParam(param, strconv.Itoa(int(nozzle)))
+			}
+			if nozzle != tool {
+				ctx.Record(n, "T%d -> T%d", tool, nozzle)
+			}
+		}
+	})
+	return gcodes
+}
+
+// reduceToolSettings returns the comment with the settings of the source tools of each nozzle
+func reduceToolSettings(comment string, sources [Nozzles][]int32) (string, bool) {
+	var prefix string
+	for _, p := range toolSettings {
+		if strings.HasPrefix(comment, p) {
+			prefix = p
+			break
+		}
+	}
+	i := strings.Index(comment, "=")
+	if prefix == "" || i < 0 || i+2 > len(comment) {
+		return comment, false
+	}
+
+	delimiter := ","
+	if strings.Contains(comment[i+1:], ";") {
+		delimiter = ";"
+	}
+	vs := strings.Split(comment[i+1:], delimiter)
+	if len(vs) < Nozzles {
+		return comment, false
+	}
+	sum := strings.HasPrefix(prefix, "; filament used [")
+
+	values := make([]string, Nozzles)
+	for nozzle, tools := range sources {
+		switch {
+		case len(tools) == 0 && sum:
+			values[nozzle] = "0"
+		case len(tools) == 0:
+			values[nozzle] = strings.TrimSpace(vs[nozzle])
+		case !sum || len(tools) == 1:
+			if int(tools[0]) >= len(vs) {
+				return comment, false
+			}
+			values[nozzle] = strings.TrimSpace(vs[tools[0]])
+		default:
+			var total float64
+			for _, t := range tools {
+				if int(t) >= len(vs) {
+					return comment, false
+				}
+				f, err := strconv.ParseFloat(strings.TrimSpace(vs[t]), 64)
+				if err != nil {
+					return comment, false
+				}
+				total += f
+			}
+			values[nozzle] = strconv.FormatFloat(math.Round(total*1e4)/1e4, 'f', -1, 64)
+		}
+	}
+	return comment[:i+2] + strings.Join(values, delimiter), true
+}
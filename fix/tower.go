@@ -0,0 +1,296 @@
+package fix
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	ReinforceExtra     = "extra"     // extrude in place before the wipe moves
+	ReinforceFlow      = "flow"      // raise the flow of the wipe moves
+	ReinforcePerimeter = "perimeter" // add perimeters around the wipe moves
+)
+
+// wipe tower markers of slicers, a tower block starts and ends at them
+var (
+	towerStartMarkers = []string{"; CP TOOLCHANGE WIPE", "; WIPE_TOWER_START"}
+	towerEndMarkers   = []string{"; CP TOOLCHANGE END", "; WIPE_TOWER_END"}
+)
+
+type towerConfig struct {
+	mode       string
+	ratio      float64
+	zmin, zmax float64 // zmax 0 is unlimited
+	perimeters int
+	width      float64 // 0 by the nozzle diameter
+}
+
+func newTowerConfig(ctx *Context) (c towerConfig, err error) {
+	c = towerConfig{
+		mode:       strings.ToLower(ctx.Options.Str("reinforce.mode", ReinforceExtra)),
+		ratio:      ctx.Options.Float("reinforce.ratio", 0.45),
+		zmin:       ctx.Options.Float("reinforce.zmin", 0.3),
+		zmax:       ctx.Options.Float("reinforce.zmax", 0),
+		perimeters: ctx.Options.Int("reinforce.perimeters", 1),
+		width:      ctx.Options.Float("reinforce.width", 0),
+	}
+	switch c.mode {
+	case ReinforceExtra, ReinforceFlow, ReinforcePerimeter:
+	default:
+		return c, fmt.Errorf("unknown reinforce.mode %q", c.mode)
+	}
+	if c.ratio <= 0 {
+		return c, fmt.Errorf("reinforce.ratio must be positive")
+	}
+	return c, nil
+}
+
+// active reports if the tower at z should be reinforced, the first layers are strong enough
+func (c towerConfig) active(z float64) bool {
+	return z > c.zmin && (c.zmax <= 0 || z <= c.zmax)
+}
+
+// towerBlock is the state of the wipe moves between the markers
+type towerBlock struct {
+	inside  bool
+	base    float32 // E of the first wipe move
+	f       float32 // F of the first wipe move
+	added   float64 // E added in the block, to restore the E axis if absolute
+	length  float64 // of the extruding moves
+	extrude float64 // E of the extruding moves
+	minX    float64
+	minY    float64
+	maxX    float64
+	maxY    float64
+
+	retracts    []*GcodeBlock // held until the perimeters are added, if they are the last moves of the block
+	retractFrom MachineState  // before the retracts
+}
+
+func (b *towerBlock) reset() {
+	*b = towerBlock{inside: b.inside, minX: math.Inf(1), minY: math.Inf(1), maxX: math.Inf(-1), maxY: math.Inf(-1)}
+}
+
+func (b *towerBlock) addMove(prev, cur MachineState, e float64) {
+	b.length += math.Hypot(cur.X-prev.X, cur.Y-prev.Y)
+	b.extrude += e
+	for _, p := range [][2]float64{{prev.X, prev.Y}, {cur.X, cur.Y}} {
+		b.minX, b.maxX = math.Min(b.minX, p[0]), math.Max(b.maxX, p[0])
+		b.minY, b.maxY = math.Min(b.minY, p[1]), math.Max(b.maxY, p[1])
+	}
+}
+
+/*
+reinforceTower adds material to the wipe tower, the thin tower of a dual extruders print is easy to fall.
+
+"reinforce.mode" is one of:
+
+	extra:     extrude "reinforce.ratio" of the first wipe move in place before each wipe move
+	flow:      raise the flow of wipe moves by "reinforce.ratio"
+	perimeter: add "reinforce.perimeters" loops around the wipe moves of each block, before its last retract
+
+only layers in "reinforce.zmin" (0.3) < Z <= "reinforce.zmax" are reinforced.
+Both relative and absolute E are supported, the E axis is restored by G92 after the absolute changes.
+*/
+func reinforceTower(ctx *Context, gcodes []*GcodeBlock) (output []*GcodeBlock, err error) {
+	cfg, err := newTowerConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output = make([]*GcodeBlock, 0, len(gcodes)+2048)
+
+	var (
+		layers = DetectLayers(gcodes)
+		state  = NewMachineState()
+		block  towerBlock
+		// E mode is not set by the file, legacy behavior assumes relative E
+		eModeSet bool
+	)
+	block.reset()
+
+	emit := func(format string, args ...any) {
+		if g, err := ParseGcodeBlock(fmt.Sprintf(format, args...)); err == nil {
+			output = append(output, g)
+		}
+	}
+	// the retracts held by perimeter mode, their absolute E is moved by the E added before them
+	flushRetracts := func(added float64) {
+		for _, g := range block.retracts {
+			if v, ok := g.paramFloat('E'); ok && added != 0 {
+				g.SetParam('E', fmt.Sprintf("%.5f", v+added))
+			}
+			output = append(output, g)
+		}
+		block.retracts = nil
+	}
+
+	for n, gcode := range gcodes {
+		var z float64
+		if l, ok := layers.Layer(n); ok {
+			z = l.Z
+		}
+		prev := state
+		state.Update(gcode)
+		if gcode.Is("M82") || gcode.Is("M83") || gcode.Is("G90") || gcode.Is("G91") {
+			eModeSet = true
+		}
+		relE := state.RelativeE || !eModeSet
+
+		if gcode.IsComment() {
+			switch {
+			case hasAnyComment(gcode, towerStartMarkers):
+				flushRetracts(0)
+				block.inside = true
+				block.reset()
+			case hasAnyComment(gcode, towerEndMarkers):
+				if block.inside && cfg.active(z) {
+					if cfg.mode == ReinforcePerimeter {
+						// the loops are extruded before the last retract of the block
+						from := prev
+						if len(block.retracts) > 0 {
+							from = block.retractFrom
+						}
+						reinforcePerimeters(ctx, cfg, &block, from, relE, emit)
+						ctx.Record(n, "reinforce tower at Z%g", z)
+					}
+					if relE {
+						flushRetracts(0)
+					} else {
+						flushRetracts(block.added)
+					}
+					if !relE && block.added != 0 {
+						emit("G92 E%.5f ;(Fixed: reinforce tower, restore E)", prev.E)
+					}
+				}
+				flushRetracts(0)
+				block.inside = false
+				block.reset()
+			}
+			output = append(output, gcode)
+			continue
+		}
+
+		if gcode.Is("G92") && gcode.HasParam('E') {
+			block.added = 0 // E axis is set by the slicer
+		}
+		var e float64 // extruded by this move
+		if relE {
+			e, _ = gcode.paramFloat('E')
+		} else {
+			e = state.E - prev.E
+		}
+		if block.inside && cfg.active(z) && cfg.mode == ReinforcePerimeter && gcode.HasParam('E') && isRetract(gcode, e) {
+			if len(block.retracts) == 0 {
+				block.retractFrom = prev
+			}
+			block.retracts = append(block.retracts, gcode)
+			continue
+		}
+		flushRetracts(0) // not the last moves of the block
+
+		if !block.inside || !cfg.active(z) || !gcode.Is("G1") || !gcode.HasParam('E') {
+			output = append(output, gcode)
+			continue
+		}
+
+		switch cfg.mode {
+		case ReinforceExtra:
+			if gcode.HasParam('F') {
+				if block.base < 0.01 {
+					block.base = float32(e) * float32(cfg.ratio)
+					gcode.GetParam('F', &block.f)
+				}
+				if block.base > 0 {
+					if relE {
+						emit("G1 E%g F%g ;(Fixed: reinforce tower)", block.base, block.f)
+					} else {
+						block.added += float64(block.base)
+						emit("G1 E%.5f F%g ;(Fixed: reinforce tower)", prev.E+block.added, block.f)
+					}
+					ctx.Record(n, "reinforce tower at Z%g", z)
+				}
+			}
+			if !relE && block.added != 0 {
+				gcode.SetParam('E', fmt.Sprintf("%.5f", state.E+block.added))
+			}
+
+		case ReinforceFlow:
+			if e > 0 {
+				if block.extrude == 0 {
+					emit(";(Fixed: reinforce tower, flow +%g%%)", math.Round(cfg.ratio*100))
+					ctx.Record(n, "reinforce tower at Z%g", z)
+				}
+				block.extrude += e
+				block.added += e * cfg.ratio
+			}
+			if relE {
+				if e > 0 {
+					gcode.SetParam('E', fmt.Sprintf("%.5f", e*(1+cfg.ratio)))
+				}
+			} else if block.added != 0 {
+				gcode.SetParam('E', fmt.Sprintf("%.5f", state.E+block.added))
+			}
+
+		case ReinforcePerimeter:
+			if e > 0 {
+				block.addMove(prev, state, e)
+				if block.f == 0 {
+					block.f = float32(state.F)
+				}
+			}
+		}
+		output = append(output, gcode)
+	}
+	flushRetracts(0)
+	return output, nil
+}
+
+// reinforcePerimeters draws loops around the wipe moves of the block, from the current position of state
+func reinforcePerimeters(ctx *Context, cfg towerConfig, block *towerBlock, state MachineState, relE bool, emit func(string, ...any)) {
+	if block.length <= 0 || block.extrude <= 0 || state.Relative {
+		return
+	}
+	width := cfg.width
+	if width <= 0 {
+		width = 0.45
+		if t := state.Tool; t >= 0 && int(t) < len(ctx.Params.NozzleDiameters) && ctx.Params.NozzleDiameters[t] > 0 {
+			width = ctx.Params.NozzleDiameters[t] * 1.125
+		}
+	}
+	var (
+		perMM = block.extrude / block.length
+		e     = state.E
+	)
+	for i := 1; i <= cfg.perimeters; i++ {
+		w := width * float64(i)
+		x0, y0, x1, y1 := block.minX-w, block.minY-w, block.maxX+w, block.maxY+w
+		emit("G1 X%.3f Y%.3f F%g ;(Fixed: reinforce tower, perimeter %d)", x0, y0, block.f, i)
+		from := [2]float64{x0, y0}
+		for _, p := range [][2]float64{{x1, y0}, {x1, y1}, {x0, y1}, {x0, y0}} {
+			amount := math.Hypot(p[0]-from[0], p[1]-from[1]) * perMM
+			from = p
+			if relE {
+				emit("G1 X%.3f Y%.3f E%.5f", p[0], p[1], amount)
+			} else {
+				e += amount
+				block.added += amount
+				emit("G1 X%.3f Y%.3f E%.5f", p[0], p[1], e)
+			}
+		}
+	}
+}
+
+// isRetract reports if g is a move of E only which pulls e back
+func isRetract(g *GcodeBlock, e float64) bool {
+	return e < 0 && g.Is("G1") && !g.HasParam('X') && !g.HasParam('Y') && !g.HasParam('Z')
+}
+
+func hasAnyComment(g *GcodeBlock, markers []string) bool {
+	for _, m := range markers {
+		if g.InComment(m) {
+			return true
+		}
+	}
+	return false
+}
@@ -124,49 +124,6 @@ func GoInParallelAndWait(work func(wi, wn int)) {
 	wg.Wait()
 }
 
-// removeDuplicateSpaces removes all consecutive spaces in a string
-func removeDuplicateSpaces(s string) string {
-	var (
-		sb        strings.Builder
-		prevSpace = false
-	)
-
-	for i := 0; i < len(s); i++ {
-		if s[i] == ' ' {
-			if !prevSpace {
-				sb.WriteByte(s[i])
-				prevSpace = true
-			}
-		} else {
-			sb.WriteByte(s[i])
-			prevSpace = false
-		}
-	}
-
-	return sb.String()
-}
-
-// removeSpecialChars removes only the escape characters \n, \t, and \r from the given string
-func removeSpecialChars(s string) string {
-	var result strings.Builder
-	for _, c := range s {
-		if c != '\n' && c != '\t' && c != '\r' {
-			result.WriteRune(c)
-		}
-	}
-	return result.String()
-}
-
-// prepareGcodeLineToParse modify a string to can be parsed for the Parse function
-// It doesn't verify if s strings is a gcode line valid
-func prepareGcodeLineToParse(s string) string {
-	s = strings.TrimSpace(s)
-	s = removeSpecialChars(s)
-	s = removeDuplicateSpaces(s)
-
-	return s
-}
-
 type elementTaken struct {
 	taken     string
 	remainder string
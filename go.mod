@@ -3,3 +3,5 @@ module github.com/macdylan/SMFix
 go 1.20
 
 require github.com/macdylan/SMFix/fix v0.0.0-20240325141746-70877a3c65b4
+
+replace github.com/macdylan/SMFix/fix => ./fix
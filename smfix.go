@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"runtime"
@@ -14,20 +14,77 @@ import (
 
 var (
 	OutputPath       string
+	ConfigPath       string
 	noTrim           bool
+	optimizeGcode    bool
 	noShutoff        bool
 	noPreheat        bool
+	noStandby        bool
 	noReinforceTower bool
 	noReplaceTool    bool
+	noToolChange     bool
+	noFans           bool
+	noColorChange    bool
+	noArcFit         bool
+	noArcExpand      bool
+	compact          bool
+	checksum         bool
+	outputEOL        string
+	verbose          bool
+
+	options = fix.Options{}
+	plugins []*fix.Plugin
 )
 
 func init() {
 	flag.StringVar(&OutputPath, "o", "", "output path, default is input path")
+	flag.StringVar(&ConfigPath, "config", "", "load options from the config file, -set overwrites them")
 	flag.BoolVar(&noTrim, "notrim", false, "do not trim spaces in the gcode")
+	flag.BoolVar(&optimizeGcode, "optimize", false, "drop redundant commands and merge travels, turn off one rule by -set optimize.<rule>=false")
 	flag.BoolVar(&noShutoff, "noshutoff", false, "do not shutoff nozzles that are no longer in use")
 	flag.BoolVar(&noPreheat, "nopreheat", true, "do not pre-heat nozzles")
+	flag.BoolVar(&noStandby, "nostandby", true, "do not drop idle nozzles to the standby temperature")
 	flag.BoolVar(&noReinforceTower, "noreinforcetower", true, "do not reinforce the prime tower")
 	flag.BoolVar(&noReplaceTool, "noreplacetool", false, "do not replace the tool number")
+	flag.Func("toolmap", "map the tools of the slicer to the nozzles, e.g. 0:1,1:0,2:0,3:1, default is T(n%2)", func(s string) error {
+		return options.Parse("toolmap=" + s)
+	})
+	flag.BoolVar(&noToolChange, "notoolchange", true, "do not rewrite tool changes by the template of the printer")
+	flag.BoolVar(&noFans, "nofans", true, "do not make fan commands follow the tools")
+	flag.BoolVar(&noArcFit, "noarcfit", true, "do not fit G1 moves into G2/G3 arcs")
+	flag.BoolVar(&noArcExpand, "noarcexpand", true, "do not expand G2/G3 arcs into G1 moves, for the firmware without arcs")
+	flag.BoolVar(&noColorChange, "nocolorchange", false, "do not turn tool changes into filament changes (M600) on single nozzle printers")
+	flag.Func("mode", "convert a single extruder J1 file to an IDEX mode: duplication, mirror, backup", func(s string) error {
+		return options.Parse("idex.mode=" + s)
+	})
+	flag.Func("inject", "insert commands at a layer or Z, e.g. -inject \"at z=12.4: M600\" (repeatable)", func(s string) error {
+		return options.Parse("inject=" + s)
+	})
+	flag.BoolVar(&checksum, "checksum", false, "renumber the lines with N and regenerate their checksums")
+	flag.BoolVar(&compact, "compact", false, "drop comments, the slicer config and thumbnails from the output, the header is kept")
+	flag.Func("eol", "line ending of the output: lf, crlf, cr, default is the same as the input", func(s string) error {
+		if s != "lf" && s != "crlf" && s != "cr" {
+			return fmt.Errorf("want lf, crlf or cr")
+		}
+		outputEOL = s
+		return nil
+	})
+	flag.IntVar(&fix.MaxLineSize, "maxline", fix.MaxLineSize, "max bytes of a line in the input")
+	flag.BoolVar(&verbose, "v", false, "print warnings and a summary of changes")
+	flag.Func("set", "set an option of modifiers, e.g. -set preheat.long=3 (repeatable)", options.Parse)
+	flag.Func("plugin", "run an external command as modifier, e.g. -plugin snapshot=/path/to/cmd (repeatable), at the end or after -set plugin.snapshot.after=<modifier>", func(s string) error {
+		name, command, _ := strings.Cut(s, "=")
+		p, err := fix.NewPlugin(name, command)
+		if err != nil {
+			return err
+		}
+		// by its name, the pipeline places it after "plugin.<name>.after" or at the end
+		if err := fix.RegisterModifier(p); err != nil {
+			return err
+		}
+		plugins = append(plugins, p)
+		return nil
+	})
 	flag.Parse()
 }
 
@@ -58,58 +115,132 @@ func main() {
 	}()
 
 	// read gcodes form file
-	gcodes := []*fix.GcodeBlock{}
-	sc := bufio.NewScanner(in)
-	for sc.Scan() {
-		line := sc.Text()
-
-		if strings.HasPrefix(line, "; Postprocessed by smfix") {
-			log.Fatalln(fix.ErrIsFixed)
-		}
-
-		g, err := fix.ParseGcodeBlock(line)
-		if err == nil {
-			// ignore G4 S0
-			if g.Is("G4") {
-				var s int
-				if err := g.GetParam('S', &s); err == nil && s == 0 {
-					continue
-				}
+	gcodes, eol, err := fix.ReadGcode(in)
+	if errors.Is(err, fix.ErrIsFixed) {
+		log.Fatalln(err)
+	}
+	if err != nil {
+		log.Fatalf("Parse gcode error: %s", err)
+	}
+	in.Close()
+	// ignore G4 S0
+	n := 0
+	for _, g := range gcodes {
+		if g.Is("G4") {
+			var s int
+			if err := g.GetParam('S', &s); err == nil && s == 0 {
+				continue
 			}
+		}
+		gcodes[n] = g
+		n++
+	}
+	gcodes = gcodes[:n]
+	switch outputEOL {
+	case "lf":
+		eol = fix.LF
+	case "crlf":
+		eol = fix.CRLF
+	case "cr":
+		eol = fix.CR
+	}
 
-			gcodes = append(gcodes, g)
-			continue
+	if len(ConfigPath) > 0 {
+		cfg, err := loadConfig(ConfigPath)
+		if err != nil {
+			log.Fatalf("Load config error: %s", err)
 		}
-		if err != fix.ErrEmptyString {
-			log.Fatalf("Parse gcode error: %s", err)
+		for key, values := range options {
+			for _, v := range values {
+				cfg.Add(key, v)
+			}
 		}
+		options = cfg
 	}
-	in.Close()
-	if err := sc.Err(); err != nil {
-		log.Fatalf("Read input file error: %s", err)
+	if err := fix.Materials.Override(options); err != nil {
+		log.Fatalf("Invalid option: %s", err)
+	}
+
+	// parse params for modifiers, headers will be extracted again after fix
+	if err := fix.ParseParams(gcodes); err != nil {
+		log.Fatalf("Parse params failed: %s", err)
+	}
+	ctx := fix.NewContext(fix.Params, options)
+	if verbose {
+		ctx.Logger = log.New(os.Stderr, "", 0)
 	}
 
 	// fix gcodes
-	funcs := make([]fix.GcodeModifier, 0, 6)
+	names := make([]string, 0, 6)
+	if options.Has("idex.mode") {
+		names = append(names, "idex")
+	}
+	// all tools are printed by the single nozzle, instead of replacing the tool number
+	colorChange := !noColorChange && fix.Params.SingleNozzle()
+	if colorChange {
+		names = append(names, "colorchange")
+	}
 	if !noTrim {
-		// funcs = append(funcs, fix.GcodeTrimLines)
+		// names = append(names, "trim")
 	}
 	if !noShutoff {
-		funcs = append(funcs, fix.GcodeFixShutoff)
+		names = append(names, "shutoff")
+	}
+	if !noStandby {
+		names = append(names, "standby")
 	}
 	if !noPreheat {
-		funcs = append(funcs, fix.GcodeFixPreheat)
+		names = append(names, "preheat")
 	}
-	if !noReplaceTool {
-		funcs = append(funcs, fix.GcodeReplaceToolNum)
+	if !noReplaceTool && !colorChange {
+		names = append(names, "replacetool")
+	}
+	if !noToolChange && !colorChange {
+		names = append(names, "toolchange")
+	}
+	if !noFans {
+		names = append(names, "fans")
 	}
 	if !noReinforceTower {
-		funcs = append(funcs, fix.GcodeReinforceTower)
+		names = append(names, "reinforcetower")
+	}
+	names = append(names, "orcatoolunload")
+	if options.Has("inject") {
+		names = append(names, "inject")
+	}
+	if !noArcExpand {
+		names = append(names, "arcexpand")
+	} else if !noArcFit {
+		names = append(names, "arcfit")
+	}
+	if options.Has("rule") {
+		names = append(names, "rules")
+	}
+	if optimizeGcode {
+		names = append(names, "optimize")
 	}
-	funcs = append(funcs, fix.GcodeFixOrcaToolUnload)
 
-	for _, fn := range funcs {
-		gcodes = fn(gcodes)
+	for _, p := range plugins {
+		if names, err = placeModifier(names, p.Name(), options.Str("plugin."+p.Name()+".after", "")); err != nil {
+			log.Fatalf("Plugin %s: %s", p.Name(), err)
+		}
+	}
+
+	pipeline, err := fix.NewPipeline(names...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if checksum {
+		m, _ := fix.LookupModifier("checksum")
+		pipeline = append(pipeline, m)
+	}
+	if gcodes, err = pipeline.Run(ctx, gcodes); err != nil {
+		log.Fatalf("Fix gcode error: %s", err)
+	}
+	if verbose {
+		for _, line := range ctx.Changes.Summary() {
+			ctx.Logger.Println(line)
+		}
 	}
 
 	// extract headers
@@ -117,6 +248,11 @@ func main() {
 	if headers, err = fix.ExtractHeader(gcodes); err != nil {
 		log.Fatalf("Parse params failed: %s", err)
 	}
+	if compact {
+		gcodes = fix.Compact(gcodes)
+		fix.Params.TotalLines = len(gcodes)
+		headers = fix.Header()
+	}
 
 	// prepare for output file
 	if len(OutputPath) == 0 {
@@ -128,18 +264,34 @@ func main() {
 	}
 	defer out.Close()
 
-	bufWriter := bufio.NewWriterSize(out, 64*1024)
-	defer bufWriter.Flush()
-
-	// write headers
-	if _, err := bufWriter.Write(bytes.Join(headers, []byte("\n"))); err != nil {
+	if err := fix.WriteGcode(out, headers, gcodes, eol); err != nil {
 		log.Fatalln(err)
 	}
+}
 
-	// write gcodes
-	for _, gcode := range gcodes {
-		if _, err := bufWriter.WriteString(gcode.String() + "\n"); err != nil {
-			log.Fatalln(err)
+func loadConfig(path string) (fix.Options, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := fix.Options{}
+	if err := cfg.Load(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// placeModifier inserts name after the modifier after in names, at the end if after is empty
+func placeModifier(names []string, name, after string) ([]string, error) {
+	if after == "" {
+		return append(names, name), nil
+	}
+	for i, n := range names {
+		if n == after {
+			return append(names[:i+1], append([]string{name}, names[i+1:]...)...), nil
 		}
 	}
+	return nil, fmt.Errorf("modifier %q is not in the pipeline", after)
 }